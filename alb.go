@@ -0,0 +1,179 @@
+package traefik_jwt_plugin
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assertion is an identity asserted by a load balancer in front of Traefik, as a token which is verified on extraction.
+type assertion interface {
+	// extract returns the verified token of the request, or nil when the request has no assertion
+	extract(request *http.Request) (*JWT, error)
+}
+
+const (
+	// albDataHeader carries the claims of users authenticated by an AWS Application Load Balancer, signed by the load balancer.
+	albDataHeader = "X-Amzn-Oidc-Data"
+	// albClockSkew is the default leeway of the expiry of the ALB tokens
+	albClockSkew = time.Minute
+	// albMissingKeyTTL is how long a kid without a public key isn't fetched again
+	albMissingKeyTTL = time.Minute
+	// albMissingKeys bounds the number of kids remembered without a public key
+	albMissingKeys = 1000
+)
+
+// AwsAlb verifies the x-amzn-oidc-data header, which AWS Application Load Balancers (e.g. with Cognito) add to
+// authenticated requests.
+type AwsAlb struct {
+	// Region of the load balancers, whose public keys verify the tokens
+	Region string
+	// Signers are the ARNs of the load balancers whose tokens are accepted, required as every load balancer of the
+	// region, also of other AWS accounts, signs with the same keys
+	Signers []string
+	// Exclusive ignores the Authorization header, by default the ALB token is only used for requests without a bearer token
+	Exclusive bool
+	// KeyEndpoint overrides the endpoint of the public keys, https://public-keys.auth.elb.<region>.amazonaws.com/
+	KeyEndpoint string
+}
+
+// albVerifier verifies the ALB tokens with the public keys of the region, which are fetched by kid.
+type albVerifier struct {
+	signers     []string
+	keyEndpoint string
+	client      *http.Client
+	lock        sync.Mutex
+	keys        map[string]*ecdsa.PublicKey
+	// missing are the kids without a public key, which aren't fetched again until the time passed
+	missing   map[string]time.Time
+	clockSkew time.Duration
+}
+
+func newAlbVerifier(config AwsAlb, clockSkew time.Duration) (*albVerifier, error) {
+	if config.Region == "" && config.KeyEndpoint == "" {
+		return nil, nil
+	}
+	if len(config.Signers) == 0 {
+		return nil, fmt.Errorf("invalid AwsAlb, expecting the Signers")
+	}
+	if clockSkew == 0 {
+		clockSkew = albClockSkew
+	}
+	keyEndpoint := config.KeyEndpoint
+	if keyEndpoint == "" {
+		keyEndpoint = fmt.Sprintf("https://public-keys.auth.elb.%s.amazonaws.com/", url.PathEscape(config.Region))
+	}
+	if _, err := url.ParseRequestURI(keyEndpoint); err != nil {
+		return nil, fmt.Errorf("invalid AwsAlb KeyEndpoint: %v", err)
+	}
+	if !strings.HasSuffix(keyEndpoint, "/") {
+		keyEndpoint += "/"
+	}
+	return &albVerifier{
+		signers:     config.Signers,
+		keyEndpoint: keyEndpoint,
+		client:      newHTTPClient(10*time.Second, nil, 2),
+		keys:        make(map[string]*ecdsa.PublicKey),
+		missing:     make(map[string]time.Time),
+		clockSkew:   clockSkew,
+	}, nil
+}
+
+// extract returns the verified ALB token of the request, or nil when the request has no ALB token.
+func (v *albVerifier) extract(request *http.Request) (*JWT, error) {
+	value := request.Header.Get(albDataHeader)
+	if value == "" {
+		return nil, nil
+	}
+	// the load balancer pads the segments, which are signed with the padding
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid ALB token: invalid token format")
+	}
+	jwtToken, err := parseToken(strings.TrimRight(parts[0], "=") + "." + strings.TrimRight(parts[1], "=") + "." + strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ALB token: %v", err)
+	}
+	jwtToken.Plaintext = []byte(parts[0] + "." + parts[1])
+	jwtToken.Raw = value
+	if jwtToken.Header.Alg != "ES256" {
+		return nil, fmt.Errorf("invalid ALB token, expecting ES256 got %s", jwtToken.Header.Alg)
+	}
+	if !containsFold(v.signers, jwtToken.Header.Signer) {
+		return nil, fmt.Errorf("ALB token signed by unexpected load balancer %s", jwtToken.Header.Signer)
+	}
+	key, err := v.key(jwtToken.Header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	a := tokenAlgorithms["ES256"]
+	if err = a.verify(key, a.hash, jwtToken.Plaintext, jwtToken.Signature); err != nil {
+		return nil, fmt.Errorf("invalid signature of ALB token: %v", err)
+	}
+	jwtToken.KeyID = jwtToken.Header.Kid
+	if exp, ok := jwtToken.Payload["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0).Add(v.clockSkew)) {
+		return nil, fmt.Errorf("ALB token is expired")
+	}
+	return jwtToken, nil
+}
+
+// key returns the public key of the kid, fetching unknown keys. Keys of a kid never change, so they are kept.
+// Kids without a key are remembered for the albMissingKeyTTL, so forged kids don't trigger a fetch per request.
+func (v *albVerifier) key(kid string) (*ecdsa.PublicKey, error) {
+	if kid == "" {
+		return nil, fmt.Errorf("invalid ALB token, expecting a kid")
+	}
+	v.lock.Lock()
+	key, ok := v.keys[kid]
+	missing, isMissing := v.missing[kid]
+	v.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+	if isMissing && time.Now().Before(missing) {
+		return nil, fmt.Errorf("unknown kid %s of ALB token", kid)
+	}
+	response, err := v.client.Get(v.keyEndpoint + url.PathEscape(kid))
+	if err != nil {
+		return nil, fmt.Errorf("fetching ALB key %s: %v", kid, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		v.remember(kid)
+		return nil, fmt.Errorf("fetching ALB key %s: unexpected status %d", kid, response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching ALB key %s: %v", kid, err)
+	}
+	keys, err := parsePEMKeys(body, kid)
+	if err != nil {
+		v.remember(kid)
+		return nil, fmt.Errorf("parsing ALB key %s: %v", kid, err)
+	}
+	key, ok = keys[kid].(*ecdsa.PublicKey)
+	if !ok {
+		v.remember(kid)
+		return nil, fmt.Errorf("parsing ALB key %s: expecting an EC public key", kid)
+	}
+	v.lock.Lock()
+	v.keys[kid] = key
+	delete(v.missing, kid)
+	v.lock.Unlock()
+	return key, nil
+}
+
+// remember records a kid without a public key.
+func (v *albVerifier) remember(kid string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.missing) >= albMissingKeys {
+		v.missing = make(map[string]time.Time)
+	}
+	v.missing[kid] = time.Now().Add(albMissingKeyTTL)
+}
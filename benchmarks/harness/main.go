@@ -0,0 +1,49 @@
+// Command harness serves the plugin in front of a no-op upstream, backed by a mock
+// OPA server, so it can be load tested with tools like hey or vegeta (see load.sh).
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	traefik_jwt_plugin "github.com/aq-systems/traefik-jwt-plugin"
+)
+
+const publicKey = "-----BEGIN PUBLIC KEY-----\nMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAnzyis1ZjfNB0bBgKFMSv\nvkTtwlvBsaJq7S5wA+kzeVOVpVWwkWdVha4s38XM/pa/yr47av7+z3VTmvDRyAHc\naT92whREFpLv9cj5lTeJSibyr/Mrm/YtjCZVWgaOYIhwrXwKLqPr/11inWsAkfIy\ntvHWTxZYEcXLgAXFuUuaS3uF9gEiNQwzGTU1v0FqkqTBr4B8nW3HCN47XUu0t8Y0\ne+lf4s4OxQawWD79J9/5d3Ry0vbV3Am1FtGJiJvOwRsIfVChDpYStTcHTCMqtvWb\nV6L11BWkpzGXSW4Hv43qa+GSYOD2QU68Mb59oSk2OB+BtOLpJofmbGEGgvmwyCI9\nMwIDAQAB\n-----END PUBLIC KEY-----"
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	opa := flag.Bool("opa", true, "check requests with the mock OPA server")
+	opaLatency := flag.Duration("opa-latency", 0, "latency added by the mock OPA server")
+	opaCache := flag.String("opa-cache", "", "OpaCacheTTL, caching is disabled when empty")
+	flag.Parse()
+
+	cfg := traefik_jwt_plugin.CreateConfig()
+	cfg.Keys = []string{publicKey}
+	cfg.JwtHeaders = map[string]string{"Subject": "sub"}
+	if *opa {
+		opaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(*opaLatency)
+			w.WriteHeader(http.StatusOK)
+			_, _ = fmt.Fprintln(w, `{ "result": { "allow": true } }`)
+		}))
+		defer opaServer.Close()
+		cfg.OpaUrl = opaServer.URL
+		cfg.OpaAllowField = "allow"
+		cfg.OpaCacheTTL = *opaCache
+	}
+	upstream := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	handler, err := traefik_jwt_plugin.New(context.Background(), upstream, cfg, "harness")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -0,0 +1,243 @@
+package traefik_jwt_plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decisionCache is a size bounded cache of OPA responses, each entry expires after a fixed TTL.
+type decisionCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]decisionCacheEntry
+	calls   map[string]*decisionCall
+}
+
+type decisionCacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// decisionCall is a query in flight, shared by all requests with the same key.
+type decisionCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+func newDecisionCache(ttl time.Duration, size int) *decisionCache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &decisionCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]decisionCacheEntry),
+		calls:   make(map[string]*decisionCall),
+	}
+}
+
+func (cache *decisionCache) get(key string) ([]byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return nil, false
+	}
+	return entry.body, true
+}
+
+// do runs the query for the key, unless a query for the same key is already in flight, in which
+// case it waits for that query and returns its result. Valid responses are stored in the cache.
+func (cache *decisionCache) do(key string, query func() ([]byte, error)) ([]byte, error) {
+	cache.lock.Lock()
+	if call, ok := cache.calls[key]; ok {
+		cache.lock.Unlock()
+		<-call.done
+		return call.body, call.err
+	}
+	call := &decisionCall{done: make(chan struct{})}
+	cache.calls[key] = call
+	cache.lock.Unlock()
+
+	call.body, call.err = query()
+
+	cache.lock.Lock()
+	if call.err == nil && json.Valid(call.body) {
+		cache.set(key, call.body)
+	}
+	delete(cache.calls, key)
+	cache.lock.Unlock()
+	close(call.done)
+	return call.body, call.err
+}
+
+// set stores the body, the lock must be held by the caller.
+func (cache *decisionCache) set(key string, body []byte) {
+	now := time.Now()
+	if len(cache.entries) >= cache.size {
+		for k, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, k)
+			}
+		}
+	}
+	if len(cache.entries) >= cache.size {
+		// still full, evict an arbitrary entry
+		for k := range cache.entries {
+			delete(cache.entries, k)
+			break
+		}
+	}
+	cache.entries[key] = decisionCacheEntry{body: body, expires: now.Add(cache.ttl)}
+}
+
+// verificationCacheMaxAge bounds the caching of tokens without an expiry or with a distant expiry.
+const verificationCacheMaxAge = 5 * time.Minute
+
+// verificationCache is an LRU cache of the tokens with a valid signature, so that repeated requests with
+// the same token skip the signature verification until the token expires. Entries are only valid for the
+// key generation they were verified with, adding or removing keys invalidates them.
+type verificationCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+type verificationCacheEntry struct {
+	hash       [sha256.Size]byte
+	kid        string
+	generation uint64
+	expires    time.Time
+}
+
+func newVerificationCache(size int) *verificationCache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &verificationCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func tokenHash(token *JWT) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write(token.Plaintext)
+	hash.Write([]byte{'.'})
+	hash.Write(token.Signature)
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// get returns the kid of the key which verified the token, when the token is cached for the key generation.
+func (cache *verificationCache) get(token *JWT, generation uint64) (string, bool) {
+	if cache == nil {
+		return "", false
+	}
+	hash := tokenHash(token)
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.entries[hash]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*verificationCacheEntry)
+	if entry.generation != generation || time.Now().After(entry.expires) {
+		cache.lru.Remove(element)
+		delete(cache.entries, hash)
+		return "", false
+	}
+	cache.lru.MoveToFront(element)
+	return entry.kid, true
+}
+
+// add caches the verified token until its expiry, evicting the least recently used token when the cache is full.
+func (cache *verificationCache) add(token *JWT, generation uint64) {
+	if cache == nil {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(verificationCacheMaxAge)
+	if exp, ok := token.Payload["exp"].(float64); ok {
+		if tokenExpires := time.Unix(int64(exp), 0); tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+	if !expires.After(now) {
+		return
+	}
+	hash := tokenHash(token)
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.entries[hash]; ok {
+		cache.lru.Remove(element)
+	}
+	for cache.lru.Len() >= cache.size {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*verificationCacheEntry).hash)
+	}
+	cache.entries[hash] = cache.lru.PushFront(&verificationCacheEntry{hash: hash, kid: token.KeyID, generation: generation, expires: expires})
+}
+
+// validCacheKeyElement tells whether the element of the OpaCacheKey is supported.
+func validCacheKeyElement(element string) bool {
+	switch element {
+	case "sub", "method", "host", "path", "query", "ip":
+		return true
+	}
+	return strings.HasPrefix(element, "header:") || strings.HasPrefix(element, "claim:")
+}
+
+// decisionCacheKey builds the cache key of the request out of the elements of the OpaCacheKey.
+func (jwtPlugin *JwtPlugin) decisionCacheKey(request *http.Request, token *JWT) string {
+	var claims map[string]interface{}
+	if token != nil {
+		claims = token.Payload
+	}
+	parts := make([]string, 0, len(jwtPlugin.opaCacheKey))
+	for _, element := range jwtPlugin.opaCacheKey {
+		switch {
+		case element == "sub":
+			parts = append(parts, claimString(claims, "sub"))
+		case element == "method":
+			parts = append(parts, request.Method)
+		case element == "host":
+			parts = append(parts, request.Host)
+		case element == "path":
+			parts = append(parts, request.URL.Path)
+		case element == "query":
+			parts = append(parts, request.URL.RawQuery)
+		case element == "ip":
+			parts = append(parts, jwtPlugin.remoteAddr(request).Client.IP)
+		case strings.HasPrefix(element, "header:"):
+			parts = append(parts, strings.Join(request.Header.Values(strings.TrimPrefix(element, "header:")), ","))
+		case strings.HasPrefix(element, "claim:"):
+			parts = append(parts, claimString(claims, strings.TrimPrefix(element, "claim:")))
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, ok := claims[name]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
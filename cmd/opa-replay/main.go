@@ -0,0 +1,256 @@
+// Command opa-replay replays recorded OPA decisions against a (new) policy or plugin configuration.
+//
+// The input file is an OPA decision log, one JSON record per line, each holding the input document the plugin
+// sent and the result OPA returned at the time:
+//
+//	{"decision_id": "...", "path": "example", "input": {"host": "localhost", "method": "GET", ...}, "result": {"allow": true}}
+//
+// The request of every input is reconstructed and checked by the plugin with the given configuration, so changes
+// of the OpaUrl, OpaBody or OpaMetadata apply like to live traffic. Each record whose verdict changed is reported.
+// The exit code is 1 when at least one verdict changed or could not be evaluated, which makes the command usable
+// as a CI gate for policy migrations.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	traefik_jwt_plugin "github.com/aq-systems/traefik-jwt-plugin"
+)
+
+// Record is a single decision of an OPA decision log. The Result is the document of the queried path, an object
+// holding the OpaAllowField or, for queries of the field itself, the verdict.
+type Record struct {
+	Input  *traefik_jwt_plugin.PayloadInput `json:"input"`
+	Result json.RawMessage                  `json:"result"`
+}
+
+// summary counts the replayed decisions.
+type summary struct {
+	total   int
+	changed int
+	failed  int
+}
+
+func main() {
+	configFile := flag.String("config", "", "plugin configuration (JSON) the decisions are replayed with")
+	opaUrl := flag.String("opa-url", "", "OPA URL to replay against (overrides the configuration)")
+	allowField := flag.String("allow-field", "", "field in the OPA result holding the verdict (overrides the configuration)")
+	name := flag.String("name", "opa-replay", "name of the middleware, passed to OPA as input.middleware")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <decision-log>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg := traefik_jwt_plugin.CreateConfig()
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			fatal(err)
+		}
+		if err = json.Unmarshal(data, cfg); err != nil {
+			fatal(fmt.Errorf("invalid configuration %s: %v", *configFile, err))
+		}
+	}
+	if *opaUrl != "" {
+		cfg.OpaUrl = *opaUrl
+	}
+	if *allowField != "" {
+		cfg.OpaAllowField = *allowField
+	}
+	if cfg.OpaUrl == "" || cfg.OpaAllowField == "" {
+		fatal(fmt.Errorf("an OPA URL and allow field are required"))
+	}
+	handler, err := traefik_jwt_plugin.New(context.Background(), http.NotFoundHandler(), cfg, *name)
+	if err != nil {
+		fatal(err)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	defer file.Close()
+
+	result, err := replay(handler.(*traefik_jwt_plugin.JwtPlugin), cfg.OpaAllowField, file, os.Stdout)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("replayed %d decisions: %d changed, %d failed\n", result.total, result.changed, result.failed)
+	if result.changed > 0 || result.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// replay checks the request of every decision of the log with the plugin and reports the changed verdicts to out.
+func replay(jwtPlugin *traefik_jwt_plugin.JwtPlugin, allowField string, log io.Reader, out io.Writer) (summary, error) {
+	var result summary
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		record, recorded, err := parseRecord(scanner.Bytes(), allowField)
+		if err != nil {
+			result.failed++
+			fmt.Fprintf(out, "line %d: ERR %v\n", line, err)
+			continue
+		}
+		if record == nil {
+			// not a decision record, e.g. a regular log line
+			continue
+		}
+		result.total++
+		allow, err := check(jwtPlugin, record.Input)
+		if err != nil {
+			result.failed++
+			fmt.Fprintf(out, "line %d: %s %s: ERR %v\n", line, record.Input.Method, describePath(record.Input), err)
+			continue
+		}
+		if allow != recorded {
+			result.changed++
+			fmt.Fprintf(out, "line %d: %s %s: %s -> %s\n", line, record.Input.Method, describePath(record.Input), verdict(recorded), verdict(allow))
+		}
+	}
+	return result, scanner.Err()
+}
+
+// parseRecord returns the decision of a line of the log and its verdict, the record is nil for other lines.
+func parseRecord(line []byte, allowField string) (*Record, bool, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, false, nil
+	}
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil || record.Input == nil || len(record.Result) == 0 {
+		return nil, false, nil
+	}
+	var allow bool
+	if err := json.Unmarshal(record.Result, &allow); err == nil {
+		return &record, allow, nil
+	}
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(record.Result, &result); err != nil {
+		return nil, false, fmt.Errorf("invalid result %s", record.Result)
+	}
+	fieldResult, ok := result[allowField]
+	if !ok {
+		return nil, false, fmt.Errorf("result missing: %v", allowField)
+	}
+	if err := json.Unmarshal(fieldResult, &allow); err != nil {
+		return nil, false, fmt.Errorf("invalid result %s: %v", allowField, err)
+	}
+	return &record, allow, nil
+}
+
+// check reconstructs the request and token of the input and returns the verdict of the plugin.
+func check(jwtPlugin *traefik_jwt_plugin.JwtPlugin, input *traefik_jwt_plugin.PayloadInput) (bool, error) {
+	request, err := newRequest(input)
+	if err != nil {
+		return false, err
+	}
+	var token *traefik_jwt_plugin.JWT
+	if input.JWTPayload != nil {
+		token = &traefik_jwt_plugin.JWT{Header: input.JWTHeader, Payload: input.JWTPayload, Raw: input.Token}
+	}
+	err = jwtPlugin.CheckOpa(request, token)
+	if err == nil {
+		return true, nil
+	}
+	if traefik_jwt_plugin.IsForbidden(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// newRequest reconstructs the request of an OPA input. The decisions of upstream middlewares are not replayed.
+func newRequest(input *traefik_jwt_plugin.PayloadInput) (*http.Request, error) {
+	u := &url.URL{Scheme: "http", Host: input.Host, Path: "/" + strings.Join(input.Path, "/"), RawQuery: input.Parameters.Encode()}
+	header := make(http.Header, len(input.Headers))
+	for k, v := range input.Headers {
+		header[k] = v
+	}
+	body, err := requestBody(input, header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(input.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	request.Host = input.Host
+	request.Header = header
+	if input.Client != nil {
+		request.RemoteAddr = net.JoinHostPort(input.Client.IP, strconv.Itoa(input.Client.Port))
+	}
+	return request, nil
+}
+
+// requestBody encodes the recorded body of the input with its content type.
+func requestBody(input *traefik_jwt_plugin.PayloadInput, contentType string) (io.Reader, error) {
+	switch {
+	case input.Body != nil:
+		data, err := json.Marshal(input.Body)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	case input.Form != nil:
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+			return strings.NewReader(input.Form.Encode()), nil
+		}
+		var data bytes.Buffer
+		writer := multipart.NewWriter(&data)
+		if err = writer.SetBoundary(params["boundary"]); err != nil {
+			return nil, err
+		}
+		for name, values := range input.Form {
+			for _, value := range values {
+				if err = writer.WriteField(name, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+		return &data, nil
+	case input.RawBody != "":
+		return strings.NewReader(input.RawBody), nil
+	}
+	return nil, nil
+}
+
+func describePath(input *traefik_jwt_plugin.PayloadInput) string {
+	return input.Host + "/" + strings.Join(input.Path, "/")
+}
+
+func verdict(allow bool) string {
+	if allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "opa-replay:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	traefik_jwt_plugin "github.com/aq-systems/traefik-jwt-plugin"
+)
+
+func TestParseRecord(t *testing.T) {
+	var tests = []struct {
+		name          string
+		line          string
+		expectedAllow bool
+		expectedNil   bool
+		expectedError bool
+	}{
+		{
+			name:          "result document",
+			line:          `{"decision_id":"1","path":"example","input":{"method":"GET"},"result":{"allow":true,"reason":""}}`,
+			expectedAllow: true,
+		},
+		{
+			name: "result of the allow field",
+			line: `{"decision_id":"2","path":"example/allow","input":{"method":"GET"},"result":false}`,
+		},
+		{
+			name:          "result without the allow field",
+			line:          `{"decision_id":"3","path":"example","input":{"method":"GET"},"result":{"other":true}}`,
+			expectedError: true,
+		},
+		{
+			name:        "audit record",
+			line:        `{"level":"info","msg":"authorization decision","decision":"allow","sub":"alice"}`,
+			expectedNil: true,
+		},
+		{
+			name:        "empty line",
+			line:        "  ",
+			expectedNil: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, allow, err := parseRecord([]byte(tt.line), "allow")
+			if tt.expectedError {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (record == nil) != tt.expectedNil {
+				t.Fatalf("Expected a record %t, received %+v", !tt.expectedNil, record)
+			}
+			if allow != tt.expectedAllow {
+				t.Fatalf("Expected verdict %t, received %t", tt.expectedAllow, allow)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// the new policy denies deletions and requires the metadata of the new configuration
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload traefik_jwt_plugin.Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		allow := payload.Input.Method != http.MethodDelete && payload.Input.JWTPayload["sub"] == "alice" &&
+			payload.Input.Metadata["env"] == "staging" && payload.Input.Body["amount"] == float64(10)
+		_, _ = fmt.Fprintf(w, `{"result":{"allow":%t}}`, allow)
+	}))
+	defer opa.Close()
+
+	cfg := traefik_jwt_plugin.CreateConfig()
+	cfg.OpaUrl = opa.URL + "/v1/data/example"
+	cfg.OpaAllowField = "allow"
+	cfg.OpaIncludeBody = true
+	cfg.OpaMetadata = map[string]string{"env": "staging"}
+	handler, err := traefik_jwt_plugin.New(context.Background(), http.NotFoundHandler(), cfg, "opa-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := strings.Join([]string{
+		`{"decision_id":"1","input":{"host":"localhost","method":"POST","path":["api","orders"],"headers":{"Content-Type":["application/json"]},"tokenPayload":{"sub":"alice"},"body":{"amount":10}},"result":{"allow":true}}`,
+		`{"level":"info","msg":"authorization decision","decision":"allow"}`,
+		`{"decision_id":"2","input":{"host":"localhost","method":"DELETE","path":["api","orders","1"],"tokenPayload":{"sub":"alice"}},"result":{"allow":true}}`,
+		`{"decision_id":"3","input":{"host":"localhost","method":"GET","path":["api","orders"],"tokenPayload":{"sub":"bob"}},"result":{"allow":false}}`,
+	}, "\n")
+	var out bytes.Buffer
+	result, err := replay(handler.(*traefik_jwt_plugin.JwtPlugin), "allow", strings.NewReader(log), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (summary{total: 3, changed: 1}) {
+		t.Fatalf("Expected 3 decisions with 1 change, received %+v: %s", result, out.String())
+	}
+	if out.String() != "line 3: DELETE localhost/api/orders/1: allow -> deny\n" {
+		t.Fatalf("Expected the changed verdict to be reported, received %q", out.String())
+	}
+}
@@ -0,0 +1,159 @@
+package traefik_jwt_plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// decisionLogBuffer bounds the events waiting to be shipped, newer events are dropped when it is full
+	decisionLogBuffer = 1000
+	// decisionLogBatch is the maximum number of events per POST
+	decisionLogBatch = 100
+	// decisionLogFlush is the maximum delay before the events are shipped
+	decisionLogFlush = time.Second
+)
+
+// decisionLog ships the decision events to the DecisionLogUrl in the background: an http(s) URL receives
+// batches of events as a JSON array, a udp:// or tcp:// address receives RFC 5424 syslog messages.
+type decisionLog struct {
+	plugin  *JwtPlugin
+	url     *url.URL
+	client  *http.Client
+	conn    net.Conn
+	events  chan *LogEvent
+	dropped int64
+}
+
+func parseDecisionLogURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DecisionLogUrl: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("invalid DecisionLogUrl scheme %s, expecting http, https, udp or tcp", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid DecisionLogUrl %s, expecting a host", rawURL)
+	}
+	return u, nil
+}
+
+func newDecisionLog(jwtPlugin *JwtPlugin, rawURL string) (*decisionLog, error) {
+	u, err := parseDecisionLogURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	d := &decisionLog{
+		plugin: jwtPlugin,
+		url:    u,
+		client: newHTTPClient(10*time.Second, nil, 2),
+		events: make(chan *LogEvent, decisionLogBuffer),
+	}
+	go d.run()
+	return d, nil
+}
+
+// send queues the event without blocking the request.
+func (d *decisionLog) send(event *LogEvent) {
+	select {
+	case d.events <- event:
+	default:
+		atomic.AddInt64(&d.dropped, 1)
+	}
+}
+
+func (d *decisionLog) run() {
+	ticker := time.NewTicker(decisionLogFlush)
+	defer ticker.Stop()
+	var batch []*LogEvent
+	for {
+		select {
+		case event := <-d.events:
+			batch = append(batch, event)
+			if len(batch) < decisionLogBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if dropped := atomic.SwapInt64(&d.dropped, 0); dropped > 0 {
+			d.plugin.logf("warn", "decision log buffer full, dropped %d events", dropped)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := d.ship(batch); err != nil {
+			d.plugin.logf("warn", "failed to ship %d decision events to %s: %v", len(batch), d.url.Host, err)
+		}
+		batch = nil
+	}
+}
+
+func (d *decisionLog) ship(batch []*LogEvent) error {
+	if d.url.Scheme == "http" || d.url.Scheme == "https" {
+		return d.post(batch)
+	}
+	return d.syslog(batch)
+}
+
+func (d *decisionLog) post(batch []*LogEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	response, err := d.client.Post(d.url.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// syslog writes a message per event with the auth facility, denials have the warning severity.
+// TCP messages are newline delimited, the connection is reopened after a failure.
+func (d *decisionLog) syslog(batch []*LogEvent) error {
+	if d.conn == nil {
+		conn, err := net.DialTimeout(d.url.Scheme, d.url.Host, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		d.conn = conn
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	for _, event := range batch {
+		priority := 4*8 + 6
+		if event.Decision == "deny" {
+			priority = 4*8 + 4
+		}
+		msg, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		line := fmt.Sprintf("<%d>1 %s %s traefik-jwt-plugin - decision - %s\n", priority, event.Time.UTC().Format(time.RFC3339Nano), hostname, msg)
+		_ = d.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := d.conn.Write([]byte(line)); err != nil {
+			d.conn.Close()
+			d.conn = nil
+			return err
+		}
+	}
+	return nil
+}
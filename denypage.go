@@ -0,0 +1,94 @@
+package traefik_jwt_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// denyPage renders the HTML page returned to browsers when a request is rejected.
+type denyPage struct {
+	// templates by language, the default template has the empty language
+	templates map[string]*template.Template
+}
+
+// denyPageData holds the variables available to the DenyPage templates.
+type denyPageData struct {
+	Status     int
+	StatusText string
+	// Reason is the deny reason of the policy, only set when ExposeDenyReason is enabled
+	Reason    string
+	RequestID string
+	Language  string
+}
+
+func newDenyPage(page string, translations map[string]string) (*denyPage, error) {
+	denyPage := &denyPage{templates: make(map[string]*template.Template)}
+	pages := map[string]string{"": page}
+	for language, translation := range translations {
+		pages[strings.ToLower(language)] = translation
+	}
+	for language, page := range pages {
+		source, err := readTemplate(page)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New("DenyPage").Parse(string(source))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DenyPage template %s: %v", language, err)
+		}
+		denyPage.templates[language] = tmpl
+	}
+	return denyPage, nil
+}
+
+// readTemplate returns the template itself when it contains markup, otherwise the content of the file.
+func readTemplate(value string) ([]byte, error) {
+	if strings.Contains(value, "<") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+func (page *denyPage) render(request *http.Request, status int, reason string) ([]byte, error) {
+	language, tmpl := page.template(request.Header.Get("Accept-Language"))
+	data := denyPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+		RequestID:  request.Header.Get("X-Request-Id"),
+		Language:   language,
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// template selects the template of the first language of the Accept-Language header which has a translation,
+// matching either the full language tag (e.g. pt-br) or its primary subtag (pt).
+func (page *denyPage) template(acceptLanguage string) (string, *template.Template) {
+	for _, language := range strings.Split(acceptLanguage, ",") {
+		language = strings.ToLower(strings.TrimSpace(strings.Split(language, ";")[0]))
+		if language == "" {
+			continue
+		}
+		if tmpl, ok := page.templates[language]; ok {
+			return language, tmpl
+		}
+		primary := strings.Split(language, "-")[0]
+		if tmpl, ok := page.templates[primary]; ok {
+			return primary, tmpl
+		}
+	}
+	return "", page.templates[""]
+}
+
+// acceptsHTML tells whether the request was sent by a browser.
+func acceptsHTML(request *http.Request) bool {
+	return strings.Contains(request.Header.Get("Accept"), "text/html")
+}
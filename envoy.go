@@ -0,0 +1,66 @@
+package traefik_jwt_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// envoyCheckResultHeader tells the upstream (and the client, on denial) the outcome of the check,
+// like the header set by the ext_authz examples of Envoy.
+const envoyCheckResultHeader = "X-Ext-Authz-Check-Result"
+
+// envoyFailureModeAllowedHeader is set on requests allowed while the authorization server is unavailable,
+// like Envoy does when failure_mode_allow is enabled.
+const envoyFailureModeAllowedHeader = "X-Envoy-Auth-Failure-Mode-Allowed"
+
+// envoyResult is the part of an OPA result which follows the conventions of the Envoy
+// ext_authz plugin of OPA (opa-envoy-plugin).
+type envoyResult struct {
+	HttpStatus           int               `json:"http_status"`
+	Body                 string            `json:"body"`
+	Headers              map[string]string `json:"headers"`
+	ResponseHeadersToAdd map[string]string `json:"response_headers_to_add"`
+}
+
+// parseEnvoyResult extracts the ext_authz fields of the OPA response, fields of unexpected types are ignored.
+func parseEnvoyResult(body []byte) envoyResult {
+	var response struct {
+		Result map[string]json.RawMessage `json:"result"`
+	}
+	var result envoyResult
+	if err := json.Unmarshal(body, &response); err != nil {
+		return result
+	}
+	_ = json.Unmarshal(response.Result["http_status"], &result.HttpStatus)
+	_ = json.Unmarshal(response.Result["body"], &result.Body)
+	_ = json.Unmarshal(response.Result["headers"], &result.Headers)
+	_ = json.Unmarshal(response.Result["response_headers_to_add"], &result.ResponseHeadersToAdd)
+	return result
+}
+
+// envoyAllowed applies an allowing ext_authz result: the headers are added to the upstream
+// request, the response_headers_to_add to the client response.
+func envoyAllowed(result envoyResult, request *http.Request, responseHeader http.Header) {
+	for k, v := range result.Headers {
+		request.Header.Set(k, v)
+	}
+	for k, v := range result.ResponseHeadersToAdd {
+		responseHeader.Set(k, v)
+	}
+	request.Header.Set(envoyCheckResultHeader, "allowed")
+}
+
+// envoyDenied converts a denying ext_authz result into the error returned to the client:
+// its http_status (default the ForbiddenStatus), body and headers.
+func envoyDenied(result envoyResult, err *forbiddenError) *forbiddenError {
+	err.status = result.HttpStatus
+	err.header = make(http.Header)
+	for k, v := range result.Headers {
+		err.header.Set(k, v)
+	}
+	err.header.Set(envoyCheckResultHeader, "denied")
+	if result.Body != "" {
+		err.body = []byte(result.Body)
+	}
+	return err
+}
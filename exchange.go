@@ -0,0 +1,172 @@
+package traefik_jwt_plugin
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType    = "urn:ietf:params:oauth:token-type:access_token"
+	// tokenExchangeMargin renews the exchanged tokens before they expire, so they don't expire on the way upstream
+	tokenExchangeMargin = 30 * time.Second
+	// tokenExchangeMaxAge bounds the caching of exchanged tokens without an expiry
+	tokenExchangeMaxAge = time.Minute
+)
+
+// TokenExchange exchanges the validated token of the request for a token scoped to the upstream service at the
+// token exchange endpoint (RFC 8693) of the authorization server, which is forwarded instead of the original token.
+type TokenExchange struct {
+	// Url of the token endpoint, e.g. https://idp.example.com/oauth2/token
+	Url string
+	// ClientId and ClientSecret authenticate the plugin to the endpoint with HTTP basic authentication
+	ClientId     string
+	ClientSecret string
+	// Audience, Scope and Resource of the requested token, e.g. the upstream service
+	Audience string
+	Scope    string
+	Resource string
+	// CacheSize bounds the number of cached tokens, 10000 by default
+	CacheSize int
+}
+
+// tokenExchanger exchanges tokens and caches the exchanged tokens by the hash of the original token until they expire.
+type tokenExchanger struct {
+	url          string
+	clientId     string
+	clientSecret string
+	form         url.Values
+	client       *http.Client
+	lock         sync.Mutex
+	size         int
+	tokens       map[[sha256.Size]byte]exchangedToken
+}
+
+type exchangedToken struct {
+	token   string
+	expires time.Time
+}
+
+func newTokenExchanger(config TokenExchange) (*tokenExchanger, error) {
+	if config.Url == "" {
+		return nil, nil
+	}
+	if u, err := url.ParseRequestURI(config.Url); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid TokenExchange Url %s, expecting an absolute URL", config.Url)
+	}
+	form := url.Values{
+		"grant_type":           {tokenExchangeGrant},
+		"subject_token_type":   {accessTokenType},
+		"requested_token_type": {accessTokenType},
+	}
+	if config.Audience != "" {
+		form.Set("audience", config.Audience)
+	}
+	if config.Scope != "" {
+		form.Set("scope", config.Scope)
+	}
+	if config.Resource != "" {
+		form.Set("resource", config.Resource)
+	}
+	size := config.CacheSize
+	if size <= 0 {
+		size = 10000
+	}
+	return &tokenExchanger{
+		url:          config.Url,
+		clientId:     config.ClientId,
+		clientSecret: config.ClientSecret,
+		form:         form,
+		client:       newHTTPClient(10*time.Second, nil, 10),
+		size:         size,
+		tokens:       make(map[[sha256.Size]byte]exchangedToken),
+	}, nil
+}
+
+// exchange returns the exchanged token of the validated token. The exchanged token is cached until it expires,
+// but not beyond the expiry of the original token.
+func (e *tokenExchanger) exchange(token string, jwtToken *JWT) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+	now := time.Now()
+	e.lock.Lock()
+	cached, ok := e.tokens[hash]
+	e.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.token, nil
+	}
+	exchanged, expiresIn, err := e.post(token)
+	if err != nil {
+		return "", err
+	}
+	expires := now.Add(tokenExchangeMaxAge)
+	if expiresIn > 0 {
+		expires = now.Add(expiresIn - tokenExchangeMargin)
+	}
+	if exp, ok := jwtToken.Payload["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(expires) {
+		expires = time.Unix(int64(exp), 0)
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.tokens) >= e.size {
+		for k, entry := range e.tokens {
+			if now.After(entry.expires) {
+				delete(e.tokens, k)
+			}
+		}
+	}
+	if len(e.tokens) >= e.size {
+		// still full, evict an arbitrary entry
+		for k := range e.tokens {
+			delete(e.tokens, k)
+			break
+		}
+	}
+	e.tokens[hash] = exchangedToken{token: exchanged, expires: expires}
+	return exchanged, nil
+}
+
+func (e *tokenExchanger) post(token string) (string, time.Duration, error) {
+	form := url.Values{"subject_token": {token}}
+	for k, v := range e.form {
+		form[k] = v
+	}
+	request, err := http.NewRequest(http.MethodPost, e.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	setClientCredentials(request, e.clientId, e.clientSecret)
+	response, err := e.client.Do(request)
+	if err != nil {
+		return "", 0, fmt.Errorf("exchanging token: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("exchanging token: %v", err)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	_ = json.Unmarshal(body, &result)
+	if response.StatusCode != http.StatusOK {
+		if result.Error != "" {
+			return "", 0, fmt.Errorf("exchanging token: %s", result.Error)
+		}
+		return "", 0, fmt.Errorf("exchanging token: unexpected status %d", response.StatusCode)
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("exchanging token: no access_token in the response")
+	}
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
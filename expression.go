@@ -0,0 +1,669 @@
+package traefik_jwt_plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// expression is a compiled authorization condition of the Expressions, a subset of the Common Expression Language:
+// the claims and request variables, literals, lists, member access and indexing, the operators ! && || == != < <= > >=
+// and in, the size function and the startsWith, endsWith, contains and matches methods. Missing claims are null.
+type expression struct {
+	source string
+	root   node
+}
+
+// node is an element of the syntax tree of an expression.
+type node interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+// expressionVariables are the variables available to the expressions.
+var expressionVariables = map[string]bool{"claims": true, "request": true}
+
+func compileExpression(source string) (*expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	return &expression{source: source, root: root}, nil
+}
+
+// evaluate tells whether the expression holds for the variables, its result must be a boolean.
+func (e *expression) evaluate(vars map[string]interface{}) (bool, error) {
+	value, err := e.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expecting a boolean result, got %v", value)
+	}
+	return result, nil
+}
+
+// expressionVars returns the variables of the expressions for the request and the claims of its token.
+func (jwtPlugin *JwtPlugin) expressionVars(request *http.Request, jwtToken *JWT) map[string]interface{} {
+	claims := map[string]interface{}{}
+	if jwtToken != nil && jwtToken.Payload != nil {
+		claims = jwtToken.Payload
+	}
+	headers := make(map[string]interface{}, len(request.Header))
+	for name, values := range request.Header {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	query := make(map[string]interface{})
+	for name, values := range request.URL.Query() {
+		if len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+	// the address of the connection, clients can set X-Forwarded-For
+	ip := connectionIP(request.RemoteAddr)
+	return map[string]interface{}{
+		"claims": claims,
+		"request": map[string]interface{}{
+			"method":  request.Method,
+			"host":    request.Host,
+			"path":    request.URL.Path,
+			"headers": headers,
+			"query":   query,
+			"ip":      ip,
+		},
+	}
+}
+
+// checkExpressions requires all the Expressions to hold for the request.
+func (jwtPlugin *JwtPlugin) checkExpressions(request *http.Request, jwtToken *JWT) error {
+	if len(jwtPlugin.expressions) == 0 {
+		return nil
+	}
+	vars := jwtPlugin.expressionVars(request, jwtToken)
+	for i, e := range jwtPlugin.expressions {
+		ok, err := e.evaluate(vars)
+		if err != nil {
+			return &forbiddenError{msg: fmt.Sprintf("evaluating expression %q: %v", e.source, err), reason: fmt.Sprintf("expression %d failed", i)}
+		}
+		if !ok {
+			return &forbiddenError{msg: fmt.Sprintf("expression %q not satisfied", e.source), reason: fmt.Sprintf("expression %d not satisfied", i)}
+		}
+	}
+	return nil
+}
+
+type exprToken struct {
+	kind string // ident, number, string or punct
+	text string
+	// value of number and string literals
+	value interface{}
+}
+
+func lexExpression(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] >= 'a' && source[i] <= 'z' || source[i] >= 'A' && source[i] <= 'Z' || source[i] >= '0' && source[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: source[start:i]})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			number, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s", source[start:i])
+			}
+			tokens = append(tokens, exprToken{kind: "number", text: source[start:i], value: number})
+		case c == '\'' || c == '"':
+			var value strings.Builder
+			start := i
+			i++
+			for {
+				if i >= len(source) {
+					return nil, fmt.Errorf("unterminated string %s", source[start:])
+				}
+				if source[i] == c {
+					i++
+					break
+				}
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+					switch source[i] {
+					case 'n':
+						value.WriteByte('\n')
+					case 't':
+						value.WriteByte('\t')
+					default:
+						value.WriteByte(source[i])
+					}
+					i++
+					continue
+				}
+				value.WriteByte(source[i])
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: "string", text: source[start:i], value: value.String()})
+		default:
+			operator := ""
+			for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "-", "(", ")", "[", "]", ".", ","} {
+				if strings.HasPrefix(source[i:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, exprToken{kind: "punct", text: operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != "string" && p.tokens[p.pos].text == text
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.peek(text) {
+		if p.pos < len(p.tokens) {
+			return fmt.Errorf("expecting %s, got %s", text, p.tokens[p.pos].text)
+		}
+		return fmt.Errorf("expecting %s at the end", text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek("||") {
+		p.pos++
+		var right node
+		if right, err = p.parseAnd(); err == nil {
+			left = &logicalNode{or: true, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (node, error) {
+	left, err := p.parseRelation()
+	for err == nil && p.peek("&&") {
+		p.pos++
+		var right node
+		if right, err = p.parseRelation(); err == nil {
+			left = &logicalNode{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseRelation() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.peek(op) {
+			p.pos++
+			right, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &relationNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (node, error) {
+	if p.peek("!") || p.peek("-") {
+		op := p.tokens[p.pos].text
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (node, error) {
+	target, err := p.parsePrimary()
+	for err == nil {
+		switch {
+		case p.peek("."):
+			p.pos++
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != "ident" {
+				return nil, errors.New("expecting a field or method name after .")
+			}
+			name := p.tokens[p.pos].text
+			p.pos++
+			if p.peek("(") {
+				var args []node
+				if args, err = p.parseArgs(); err == nil {
+					target, err = newMethodNode(target, name, args)
+				}
+			} else {
+				target = &indexNode{target: target, index: &literalNode{value: name}}
+			}
+		case p.peek("["):
+			p.pos++
+			var index node
+			if index, err = p.parseOr(); err == nil {
+				if err = p.expect("]"); err == nil {
+					target = &indexNode{target: target, index: index}
+				}
+			}
+		default:
+			return target, nil
+		}
+	}
+	return nil, err
+}
+
+// parseArgs parses the parenthesized arguments of a call.
+func (p *exprParser) parseArgs() ([]node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []node
+	for !p.peek(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+	return args, nil
+}
+
+func (p *exprParser) parsePrimary() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case "number", "string":
+		return &literalNode{value: token.value}, nil
+	case "ident":
+		switch token.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		case "size":
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, errors.New("size expects a single argument")
+			}
+			return &sizeNode{operand: args[0]}, nil
+		}
+		if !expressionVariables[token.text] {
+			return nil, fmt.Errorf("unknown variable %s, expecting claims or request", token.text)
+		}
+		return &variableNode{name: token.text}, nil
+	}
+	switch token.text {
+	case "(":
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case "[":
+		list := &listNode{}
+		for !p.peek("]") {
+			if len(list.elements) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			element, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			list.elements = append(list.elements, element)
+		}
+		p.pos++
+		return list, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", token.text)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(vars map[string]interface{}) (interface{}, error) {
+	return vars[n.name], nil
+}
+
+type listNode struct {
+	elements []node
+}
+
+func (n *listNode) eval(vars map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.elements))
+	for _, element := range n.elements {
+		value, err := element.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// indexNode reads a field of an object or an element of a list, which is null when missing.
+type indexNode struct {
+	target node
+	index  node
+}
+
+func (n *indexNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch target := target.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid key %v, expecting a string", index)
+		}
+		return target[key], nil
+	case []interface{}:
+		i, ok := index.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid index %v, expecting a number", index)
+		}
+		if i < 0 || int(i) >= len(target) {
+			return nil, nil
+		}
+		return target[int(i)], nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("can't index %v", target)
+}
+
+type logicalNode struct {
+	or    bool
+	left  node
+	right node
+}
+
+func (n *logicalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := evalBool(n.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	if left == n.or {
+		return left, nil
+	}
+	return evalBool(n.right, vars)
+}
+
+func evalBool(n node, vars map[string]interface{}) (bool, error) {
+	value, err := n.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expecting a boolean, got %v", value)
+	}
+	return b, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	if n.op == "!" {
+		b, err := evalBool(n.operand, vars)
+		return !b, err
+	}
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("can't negate %v", value)
+	}
+	return -number, nil
+}
+
+type relationNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *relationNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(left, right), nil
+	case "!=":
+		return !reflect.DeepEqual(left, right), nil
+	case "in":
+		switch right := right.(type) {
+		case []interface{}:
+			for _, element := range right {
+				if reflect.DeepEqual(left, element) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, ok = right[key]
+			return ok, nil
+		case nil:
+			return false, nil
+		}
+		return nil, fmt.Errorf("can't search %v", right)
+	}
+	var cmp int
+	switch left := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("can't compare %v with %v", left, right)
+		}
+		switch {
+		case left < r:
+			cmp = -1
+		case left > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("can't compare %v with %v", left, right)
+		}
+		cmp = strings.Compare(left, r)
+	default:
+		return nil, fmt.Errorf("can't compare %v with %v", left, right)
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+type sizeNode struct {
+	operand node
+}
+
+func (n *sizeNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case string:
+		return float64(len(value)), nil
+	case []interface{}:
+		return float64(len(value)), nil
+	case map[string]interface{}:
+		return float64(len(value)), nil
+	case nil:
+		return float64(0), nil
+	}
+	return nil, fmt.Errorf("can't take the size of %v", value)
+}
+
+// methodNode calls a string method, contains also searches lists. The pattern of matches is compiled once
+// when it is a literal.
+type methodNode struct {
+	target node
+	name   string
+	arg    node
+	regex  *regexp.Regexp
+}
+
+func newMethodNode(target node, name string, args []node) (node, error) {
+	switch name {
+	case "startsWith", "endsWith", "contains", "matches":
+	default:
+		return nil, fmt.Errorf("unknown method %s, expecting startsWith, endsWith, contains or matches", name)
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects a single argument", name)
+	}
+	method := &methodNode{target: target, name: name, arg: args[0]}
+	if literal, ok := args[0].(*literalNode); ok && name == "matches" {
+		pattern, ok := literal.value.(string)
+		if !ok {
+			return nil, errors.New("matches expects a string pattern")
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		method.regex = regex
+	}
+	return method, nil
+}
+
+func (n *methodNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	arg, err := n.arg.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if list, ok := target.([]interface{}); ok && n.name == "contains" {
+		for _, element := range list {
+			if reflect.DeepEqual(element, arg) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	if target == nil {
+		// missing claims don't match
+		return false, nil
+	}
+	s, ok := target.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string, got %v", n.name, target)
+	}
+	a, ok := arg.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string argument, got %v", n.name, arg)
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(s, a), nil
+	case "endsWith":
+		return strings.HasSuffix(s, a), nil
+	case "contains":
+		return strings.Contains(s, a), nil
+	}
+	regex := n.regex
+	if regex == nil {
+		if regex, err = regexp.Compile(a); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", a, err)
+		}
+	}
+	return regex.MatchString(s), nil
+}
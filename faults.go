@@ -0,0 +1,63 @@
+package traefik_jwt_plugin
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// faultInjectionEnv must be set to true to enable the FaultInjection, so a configuration copied
+// from staging can't inject faults in production.
+const faultInjectionEnv = "JWT_PLUGIN_FAULT_INJECTION"
+
+// FaultInjection rehearses failures of the dependencies of the plugin, using the real code paths.
+type FaultInjection struct {
+	// OpaTimeoutProbability is the fraction (0 to 1) of OPA requests which time out after the OpaTimeout
+	OpaTimeoutProbability float64
+	// JwksStale skips the refresh of the JWK endpoints, keeping the keys fetched at startup
+	JwksStale bool
+	// VerifyLatency is added to every signature verification, e.g. 50ms
+	VerifyLatency string
+}
+
+// faults is the FaultInjection of a plugin instance, nil unless enabled by the environment.
+type faults struct {
+	opaTimeoutProbability float64
+	jwksStale             bool
+	verifyLatency         time.Duration
+}
+
+func newFaults(config FaultInjection) (*faults, error) {
+	if config == (FaultInjection{}) || os.Getenv(faultInjectionEnv) != "true" {
+		return nil, nil
+	}
+	if config.OpaTimeoutProbability < 0 || config.OpaTimeoutProbability > 1 {
+		return nil, fmt.Errorf("invalid OpaTimeoutProbability %v, expecting a value between 0 and 1", config.OpaTimeoutProbability)
+	}
+	f := &faults{opaTimeoutProbability: config.OpaTimeoutProbability, jwksStale: config.JwksStale}
+	if config.VerifyLatency != "" {
+		var err error
+		if f.verifyLatency, err = time.ParseDuration(config.VerifyLatency); err != nil {
+			return nil, fmt.Errorf("invalid VerifyLatency: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// opaTimeout tells whether the OPA request should time out.
+func (f *faults) opaTimeout() bool {
+	return f != nil && f.opaTimeoutProbability > 0 && rand.Float64() < f.opaTimeoutProbability
+}
+
+// staleJwks tells whether the refresh of the JWK endpoints should be skipped.
+func (f *faults) staleJwks() bool {
+	return f != nil && f.jwksStale
+}
+
+// delayVerify adds the VerifyLatency.
+func (f *faults) delayVerify() {
+	if f != nil && f.verifyLatency > 0 {
+		time.Sleep(f.verifyLatency)
+	}
+}
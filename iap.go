@@ -0,0 +1,143 @@
+package traefik_jwt_plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// iapAssertionHeader carries the identity of users authenticated by Google Cloud Identity-Aware Proxy
+	iapAssertionHeader = "X-Goog-Iap-Jwt-Assertion"
+	iapIssuer          = "https://cloud.google.com/iap"
+	iapJwksUrl         = "https://www.gstatic.com/iap/verify/public_key-jwk"
+	// iapJwksMinRefresh limits the refreshes of the keys triggered by unknown kids
+	iapJwksMinRefresh = time.Minute
+	// iapClockSkew is the tolerance of the time claims, unless a ClockSkew is configured
+	iapClockSkew = time.Minute
+)
+
+// iapAudience matches the audiences of IAP assertions, of backend services and of App Engine apps.
+var iapAudience = regexp.MustCompile(`^/projects/[0-9]+/(global/backendServices/[0-9]+|apps/[a-z][-a-z0-9]*)$`)
+
+// GoogleIap verifies the x-goog-iap-jwt-assertion header, which Google Cloud Identity-Aware Proxy adds to
+// authenticated requests.
+type GoogleIap struct {
+	// Audiences of the protected services, e.g. /projects/PROJECT_NUMBER/global/backendServices/SERVICE_ID
+	// or /projects/PROJECT_NUMBER/apps/PROJECT_ID for App Engine
+	Audiences []string
+	// Exclusive ignores the Authorization header, by default the assertion is only used for requests without a bearer token
+	Exclusive bool
+	// JwksUrl overrides the keys of IAP, https://www.gstatic.com/iap/verify/public_key-jwk
+	JwksUrl string
+}
+
+// iapVerifier verifies the IAP assertions with the keys of Google, which are refreshed when an unknown kid shows up.
+type iapVerifier struct {
+	audiences []string
+	jwksUrl   string
+	client    *http.Client
+	lock      sync.Mutex
+	keys      map[string]interface{}
+	fetched   time.Time
+	clockSkew time.Duration
+}
+
+func newIapVerifier(config GoogleIap, clockSkew time.Duration) (*iapVerifier, error) {
+	if len(config.Audiences) == 0 {
+		return nil, nil
+	}
+	for _, audience := range config.Audiences {
+		if !iapAudience.MatchString(audience) {
+			return nil, fmt.Errorf("invalid GoogleIap audience %s, expecting /projects/PROJECT_NUMBER/global/backendServices/SERVICE_ID or /projects/PROJECT_NUMBER/apps/PROJECT_ID", audience)
+		}
+	}
+	jwksUrl := config.JwksUrl
+	if jwksUrl == "" {
+		jwksUrl = iapJwksUrl
+	}
+	if clockSkew == 0 {
+		clockSkew = iapClockSkew
+	}
+	return &iapVerifier{
+		audiences: config.Audiences,
+		jwksUrl:   jwksUrl,
+		client:    newHTTPClient(10*time.Second, nil, 2),
+		clockSkew: clockSkew,
+	}, nil
+}
+
+func (v *iapVerifier) extract(request *http.Request) (*JWT, error) {
+	value := request.Header.Get(iapAssertionHeader)
+	if value == "" {
+		return nil, nil
+	}
+	jwtToken, err := parseToken(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IAP assertion: %v", err)
+	}
+	if jwtToken.Header.Alg != "ES256" {
+		return nil, fmt.Errorf("invalid IAP assertion, expecting ES256 got %s", jwtToken.Header.Alg)
+	}
+	key, err := v.key(jwtToken.Header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	a := tokenAlgorithms["ES256"]
+	if err = a.verify(key, a.hash, jwtToken.Plaintext, jwtToken.Signature); err != nil {
+		return nil, fmt.Errorf("invalid signature of IAP assertion: %v", err)
+	}
+	jwtToken.KeyID = jwtToken.Header.Kid
+	if iss, _ := jwtToken.Payload["iss"].(string); iss != iapIssuer {
+		return nil, fmt.Errorf("invalid issuer %s of IAP assertion", iss)
+	}
+	if aud, _ := jwtToken.Payload["aud"].(string); !containsFold(v.audiences, aud) {
+		return nil, fmt.Errorf("invalid audience %s of IAP assertion", aud)
+	}
+	now := time.Now()
+	if exp, ok := jwtToken.Payload["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0).Add(v.clockSkew)) {
+		return nil, fmt.Errorf("IAP assertion is expired")
+	}
+	if iat, ok := jwtToken.Payload["iat"].(float64); !ok || time.Unix(int64(iat), 0).After(now.Add(v.clockSkew)) {
+		return nil, fmt.Errorf("IAP assertion is issued in the future")
+	}
+	return jwtToken, nil
+}
+
+// key returns the key of the kid, refreshing the keys for an unknown kid at most once per iapJwksMinRefresh.
+func (v *iapVerifier) key(kid string) (interface{}, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetched) < iapJwksMinRefresh {
+		return nil, fmt.Errorf("unknown kid %s of IAP assertion", kid)
+	}
+	v.fetched = time.Now()
+	response, err := v.client.Get(v.jwksUrl)
+	if err != nil {
+		return nil, fmt.Errorf("fetching IAP keys: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching IAP keys: unexpected status %d", response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching IAP keys: %v", err)
+	}
+	keys, err := parseJWKs(body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching IAP keys: %v", err)
+	}
+	v.keys = keys
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %s of IAP assertion", kid)
+	}
+	return key, nil
+}
@@ -0,0 +1,134 @@
+package traefik_jwt_plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Introspection verifies opaque bearer tokens with the introspection endpoint (RFC 7662) of the authorization server.
+// Tokens which are not JWTs are sent to the endpoint, the claims of active tokens pass the same checks, headers and
+// OPA policy as the claims of JWTs.
+type Introspection struct {
+	// Url of the introspection endpoint, e.g. https://idp.example.com/oauth2/introspect
+	Url string
+	// ClientId and ClientSecret authenticate the plugin to the endpoint with HTTP basic authentication
+	ClientId     string
+	ClientSecret string
+	// CacheTTL is how long the responses are cached, 1m by default, 0 disables the cache. Cached tokens are
+	// rejected after their expiry.
+	CacheTTL string
+	// CacheSize bounds the number of cached responses, 10000 by default
+	CacheSize int
+}
+
+// introspector posts opaque tokens to the introspection endpoint and caches the responses by token hash.
+type introspector struct {
+	url          string
+	clientId     string
+	clientSecret string
+	client       *http.Client
+	cache        *decisionCache
+	clockSkew    time.Duration
+}
+
+func newIntrospector(config Introspection, clockSkew time.Duration) (*introspector, error) {
+	if config.Url == "" {
+		return nil, nil
+	}
+	if u, err := url.ParseRequestURI(config.Url); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Introspection Url %s, expecting an absolute URL", config.Url)
+	}
+	ttl := time.Minute
+	if config.CacheTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(config.CacheTTL); err != nil {
+			return nil, fmt.Errorf("invalid Introspection CacheTTL: %v", err)
+		}
+	}
+	i := &introspector{
+		url:          config.Url,
+		clientId:     config.ClientId,
+		clientSecret: config.ClientSecret,
+		client:       newHTTPClient(10*time.Second, nil, 10),
+		clockSkew:    clockSkew,
+	}
+	if ttl > 0 {
+		i.cache = newDecisionCache(ttl, config.CacheSize)
+	}
+	return i, nil
+}
+
+// opaqueToken tells whether the bearer token is not a JWT and is introspected instead.
+func opaqueToken(token string) bool {
+	return strings.Count(token, ".") != 2
+}
+
+// introspect returns the claims of an active token as a token, and an error for inactive tokens.
+func (i *introspector) introspect(token string) (*JWT, error) {
+	var body []byte
+	var err error
+	if i.cache != nil {
+		hash := sha256.Sum256([]byte(token))
+		key := hex.EncodeToString(hash[:])
+		var ok bool
+		if body, ok = i.cache.get(key); !ok {
+			body, err = i.cache.do(key, func() ([]byte, error) { return i.post(token) })
+		}
+	} else {
+		body, err = i.post(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err = json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %v", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, fmt.Errorf("token is not active")
+	}
+	// cached responses may outlive the token
+	if exp, ok := claims["exp"].(float64); ok && time.Now().After(time.Unix(int64(exp), 0).Add(i.clockSkew)) {
+		return nil, fmt.Errorf("token is expired")
+	}
+	return &JWT{Payload: claims, Raw: token}, nil
+}
+
+// setClientCredentials authenticates the request of the plugin to the authorization server, RFC 6749
+// form encodes the credentials before the basic authentication.
+func setClientCredentials(request *http.Request, clientId string, clientSecret string) {
+	if clientId != "" {
+		request.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+	}
+}
+
+func (i *introspector) post(token string) ([]byte, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest(http.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	setClientCredentials(request, i.clientId, i.clientSecret)
+	response, err := i.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("introspecting token: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("introspecting token: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspecting token: unexpected status %d", response.StatusCode)
+	}
+	return body, nil
+}
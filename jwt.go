@@ -9,10 +9,14 @@ import (
 	"crypto/hmac"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -22,8 +26,14 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
@@ -46,44 +56,525 @@ type Config struct {
 	MagicToken             string
 	MagicTokenForwardAuth  string
 	Logging                bool
+	LogLevel               string
+
+	TrustedIdentityHeader       string
+	TrustedIdentityFormat       string
+	TrustedIdentitySourceRanges []string
+
+	OpaTimeout            string
+	OpaRetries            int
+	OpaRetryBackoff       string
+	OpaClientCert         string
+	OpaClientKey          string
+	OpaCaCert             string
+	OpaAuthHeaders        map[string]string
+	OpaFailureMode        string
+	OpaCacheTTL           string
+	OpaCacheKey           []string
+	OpaCacheSize          int
+	OpaUpstreamHeaders    []string
+	OpaIncludeBody        bool
+	OpaBodyTypes          []string
+	OpaBodyLimit          int64
+	OpaBodySpillThreshold int64
+	OpaRawBody            string
+	OpaMaxIdleConns       int
+	OpaMetadata           map[string]string
+	OpaResultSchema       string
+	OpaResponseHeaders    map[string]string
+	OpaIncludeToken       bool
+
+	AnonymousIdentity bool
+	AnonymousClaims   map[string]string
+
+	RequestTags []RequestTag
+
+	EmergencyTokens []EmergencyToken
+
+	UnauthorizedStatus int
+	ForbiddenStatus    int
+
+	JwtHeaderRules []JwtHeaderRule
+
+	ExposeDenyReason bool
+	DenyReasonHeader string
+
+	Audiences []string
+
+	RetiredKeys map[string]string
+
+	ProxyAuthorization bool
+
+	ValidateExpiry       bool
+	ServiceTokenSubjects []string
+
+	JwksTimeout string
+
+	UserinfoHeader string
+	UserinfoClaims []string
+
+	EnvoyExtAuthz bool
+
+	DenyPage             string
+	DenyPageTranslations map[string]string
+
+	StageRules []StageRule
+
+	PropagateRetryAfter bool
+
+	RequireClaims []ClaimRule
+
+	Transforms []Transform
+
+	FaultInjection FaultInjection
+
+	RequiredScopes []string
+
+	RequiredRoles []string
+	RolesHeader   string
+
+	ArrayClaimDelimiter string
+
+	ForwardPayloadHeader string
+
+	ErrorFormat  string
+	ErrorMessage string
+
+	Realm string
+
+	ErrorMode string
+
+	SkipPaths []string
+
+	IgnorePreflight bool
+
+	HostOverrides []HostOverride
+
+	AllowAnonymous   bool
+	AuthStatusHeader string
+
+	Tracing bool
+
+	AuditLog bool
+
+	DecisionLogUrl string
+
+	VerificationCacheSize    int
+	DisableVerificationCache bool
+
+	KeyFilesInterval string
+
+	HmacSecrets []string
+
+	AwsAlb    AwsAlb
+	GoogleIap GoogleIap
+
+	Introspection Introspection
+
+	TokenExchange TokenExchange
+
+	RequireTokenType string
+
+	MagicTokens []MagicToken
+
+	PreventReplay   bool
+	ReplayCacheSize int
+
+	RevocationUrl      string
+	RevocationInterval string
+
+	MaxTokenLifetime string
+
+	ClockSkew string
+
+	RequireKid bool
+
+	AllowedSubjects []string
+	DeniedSubjects  []string
+
+	Expressions []string
+
+	AccessRules []AccessRule
+
+	RateLimit RateLimit
+
+	NetworkRules []NetworkRule
+
+	Tenants map[string]Tenant
+}
+
+// HostOverride replaces settings of the configuration for requests to some hosts, so a single middleware
+// can serve several host rules. Empty settings fall back to the global configuration.
+type HostOverride struct {
+	// Hosts the override applies to, either exact host names or wildcards like *.example.com
+	Hosts          []string
+	Keys           []string
+	Iss            string
+	Audiences      []string
+	OpaUrl         string
+	OpaAllowField  string
+	RequireClaims  []ClaimRule
+	RequiredScopes []string
+}
+
+// Tenant is the issuer of the tokens accepted on the hosts of a tenant, for multi-tenant services behind a single
+// middleware. Tenants are keyed by host name, or wildcards like *.example.com.
+type Tenant struct {
+	// Iss is the issuer of the tenant
+	Iss string
+	// JwksUrl is the JWK endpoint of the issuer
+	JwksUrl string
+	// Audiences accepted for the tenant, e.g. the API of the tenant
+	Audiences []string
+}
+
+// JwtHeaderRule maps a claim of the token to an HTTP header.
+type JwtHeaderRule struct {
+	Header string
+	Claim  string
+	// Target is request (the upstream request, default), response (the client response) or both
+	Target string
+	// Mode is append (add to existing values, default) or override (replace existing values)
+	Mode string
+}
+
+// ClaimRule requires a claim to have an expected value, for simple authorization without OPA.
+// For array claims, any element may match.
+type ClaimRule struct {
+	// Claim to check, nested claims are addressed with dots, e.g. realm_access.roles
+	Claim string
+	// AnyOf lists the accepted values of the claim
+	AnyOf []string
+	// Equals is the single accepted value of the claim, e.g. true
+	Equals string
+}
+
+// AccessRule requires scopes, roles or claims for the matching requests, in addition to the global ones, e.g.
+// the admin role for POST /admin/**. The first matching rule applies, requests without a token are rejected.
+type AccessRule struct {
+	// Paths the rule applies to. `*` matches a single path segment, `**` any number of segments.
+	Paths []string
+	// Methods the rule applies to. When empty, the rule applies to all methods.
+	Methods []string
+	// RequiredScopes, RequiredRoles and RequireClaims are checked like the global options of the same name
+	RequiredScopes []string
+	RequiredRoles  []string
+	RequireClaims  []ClaimRule
+}
+
+// NetworkRule restricts the tokens with a claim value to clients connecting from networks, e.g. the tokens with
+// env=staging to 10.0.0.0/8. All the matching rules apply.
+type NetworkRule struct {
+	// Claim is the name or dot-path of the claim
+	Claim string
+	// AnyOf lists the values of the claim the rule applies to
+	AnyOf []string
+	// SourceRanges are the CIDR ranges the clients must connect from
+	SourceRanges []string
+}
+
+type networkRule struct {
+	claim        string
+	anyOf        []string
+	sourceRanges []*net.IPNet
+}
+
+// StageRule disables stages of the pipeline for the matching requests. The first matching rule applies.
+type StageRule struct {
+	// Paths the rule applies to. `*` matches a single path segment, `**` any number of segments.
+	Paths []string
+	// Methods the rule applies to. When empty, the rule applies to all methods.
+	Methods []string
+	// SkipJwt ignores the token of the request, e.g. for public endpoints which are only checked by OPA
+	SkipJwt bool
+	// SkipOpa skips the OPA check, e.g. for endpoints which only require a valid token
+	SkipOpa bool
+}
+
+// EmergencyToken is a break-glass token which bypasses the token and OPA checks,
+// e.g. during an outage of the identity provider. Every use is logged.
+type EmergencyToken struct {
+	// Name identifies the token in the logs
+	Name string
+	// Hash is the hex encoded SHA-256 hash of the token
+	Hash string
+	// Expires is the RFC 3339 time after which the token is no longer accepted
+	Expires string
+	// Paths restricts the token to the matching request paths. `*` matches a single
+	// path segment, `**` any number of segments.
+	Paths []string
+}
+
+// MagicToken lets testing tools bypass the token checks with a fake user, when EnableMagicToken is set.
+type MagicToken struct {
+	// Token is the bearer token of the tool
+	Token string
+	// ForwardAuth is the value of the ForwardAuthHeader for the requests with the token
+	ForwardAuth string
+	// Expires is the optional RFC 3339 time after which the token is no longer accepted
+	Expires string
+	// SourceRanges restricts the token to clients connecting from the CIDR ranges, e.g. 10.0.0.0/8
+	SourceRanges []string
+}
+
+// RequestTag sets a request header derived from the claims, which later middlewares
+// (rate limits, router rules) can key on.
+type RequestTag struct {
+	// Header to set, e.g. X-Auth-Tier
+	Header string
+	// Value of the header, e.g. premium
+	Value string
+	// Claim to match. When empty, the tag is set for every token.
+	Claim string
+	// Values of the claim that match. When empty, the tag is set when the claim is present.
+	Values []string
 }
 
 // CreateConfig creates a new OPA Config
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		OpaIncludeBody:      true,
+		ArrayClaimDelimiter: ",",
+	}
 }
 
 // JwtPlugin contains the runtime config
 type JwtPlugin struct {
 	next          http.Handler
+	name          string
 	opaUrl        string
 	opaAllowField string
 	payloadFields []string
 	required      bool
 	jwkEndpoints  []*url.URL
+	keysLock      sync.RWMutex
 	keys          map[string]interface{}
 	alg           string
 	iss           string
-	aud           string
+	audiences     []string
 	opaHeaders    map[string]string
-	jwtHeaders    map[string]string
+	transformer   *transformer
 
 	forwardAuthHeader      string
 	forwardAuthErrorHeader string
 	enableMagicToken       bool
-	magicToken             string
-	magicTokenForwardAuth  string
-	logging                bool
+	magicTokens            []magicToken
+	logLevel               int
+	loggerLock             sync.RWMutex
+	logger                 Logger
+
+	trustedIdentityHeader       string
+	trustedIdentityFormat       string
+	trustedIdentitySourceRanges []*net.IPNet
+
+	opaUrlTemplate        *template.Template
+	opaUrlStatic          string
+	opaClient             *http.Client
+	jwksClient            *http.Client
+	opaRetries            int
+	opaRetryBackoff       time.Duration
+	opaAuthHeaders        map[string]string
+	opaFailureMode        string
+	opaCache              *decisionCache
+	opaCacheKey           []string
+	opaUpstreamHeaders    []string
+	opaIncludeBody        bool
+	opaBodyTypes          []string
+	opaBodyLimit          int64
+	opaBodySpillThreshold int64
+	opaRawBody            string
+	opaMetadata           map[string]string
+	opaResultSchema       *jsonSchema
+	opaResponseHeaders    map[string]string
+	opaIncludeToken       bool
+
+	anonymousIdentity bool
+	anonymousClaims   map[string]string
+
+	requestTags []RequestTag
+
+	emergencyTokens []emergencyToken
+
+	unauthorizedStatus int
+	forbiddenStatus    int
+
+	exposeDenyReason bool
+	denyReasonHeader string
+
+	retiredKeys map[string]time.Time
+
+	proxyAuthorization bool
+
+	validateExpiry       bool
+	serviceTokenSubjects []string
+
+	userinfoHeader string
+	userinfoClaims []string
+
+	envoyExtAuthz bool
+
+	denyPage *denyPage
+
+	stageRules []StageRule
+
+	opaThrottle         throttle
+	jwksThrottles       map[string]*throttle
+	propagateRetryAfter bool
+
+	requireClaims []ClaimRule
+
+	faults *faults
+
+	requiredScopes []string
+
+	requiredRoles []string
+	rolesHeader   string
+
+	forwardPayloadHeader string
+
+	errorFormat  string
+	errorMessage *template.Template
+
+	realm string
+
+	errorMode string
+
+	skipPaths       []string
+	skipPathRegexes []*regexp.Regexp
+
+	ignorePreflight bool
+
+	hostPlugins []hostPlugin
+	// tenants rejects the requests to hosts which are not a tenant
+	tenants bool
+
+	allowAnonymous   bool
+	authStatusHeader string
+
+	tracing bool
+
+	auditLog    bool
+	decisionLog *decisionLog
+
+	verificationCache *verificationCache
+	keysGeneration    uint64
+
+	keyFiles []*keyFile
+
+	assertions          []assertion
+	assertionsExclusive bool
+
+	introspector *introspector
+
+	tokenExchanger *tokenExchanger
+
+	requireTokenType string
+
+	preventReplay bool
+	replayLock    sync.RWMutex
+	replayStore   ReplayStore
+
+	revocations *revocations
+
+	maxTokenLifetime time.Duration
+
+	clockSkew time.Duration
+
+	requireKid bool
+
+	allowedSubjects []string
+	deniedSubjects  []string
+
+	expressions []*expression
+
+	accessRules []AccessRule
+
+	rateLimiter *rateLimiter
+
+	networkRules []networkRule
+
+	// identityHeaders are set by the plugin, inbound values are removed so they can't be spoofed
+	identityHeaders []string
+}
+
+// hostPlugin serves the requests to the hosts of a HostOverride.
+type hostPlugin struct {
+	hosts  []string
+	plugin http.Handler
+}
+
+type magicToken struct {
+	hash         []byte
+	forwardAuth  string
+	expires      time.Time
+	sourceRanges []*net.IPNet
+}
+
+type emergencyToken struct {
+	name    string
+	hash    []byte
+	expires time.Time
+	paths   []string
 }
 
 // LogEvent contains a single log entry
 type LogEvent struct {
-	Level   string    `json:"level"`
-	Msg     string    `json:"msg"`
-	Time    time.Time `json:"time"`
-	Network `json:"network"`
-	URL     string `json:"url"`
-	Sub     string `json:"sub"`
+	Level      string    `json:"level"`
+	Msg        string    `json:"msg"`
+	Time       time.Time `json:"time"`
+	Network    `json:"network"`
+	URL        string `json:"url"`
+	Sub        string `json:"sub"`
+	Middleware string `json:"middleware,omitempty"`
+	RequestID  string `json:"requestId,omitempty"`
+	Kid        string `json:"kid,omitempty"`
+	// the fields of audit records
+	Iss          string  `json:"iss,omitempty"`
+	Jti          string  `json:"jti,omitempty"`
+	Method       string  `json:"method,omitempty"`
+	Path         string  `json:"path,omitempty"`
+	Decision     string  `json:"decision,omitempty"`
+	Reason       string  `json:"reason,omitempty"`
+	OpaLatencyMs float64 `json:"opaLatencyMs,omitempty"`
+}
+
+// requestRecord collects the outcome of the checks of a request and the time spent in each stage,
+// for the audit log and the latency breakdown.
+type requestRecord struct {
+	token          *JWT
+	extractLatency time.Duration
+	verifyLatency  time.Duration
+	opaLatency     time.Duration
+	headersLatency time.Duration
+	// exchangedToken replaces the token of the request upstream
+	exchangedToken string
+	// trustedIdentity is the value of the TrustedIdentityHeader, which is removed from the request
+	trustedIdentity string
+	// decision of OPA, made available to plugin instances further down the chain
+	decision *UpstreamDecision
+}
+
+// StartupEvent is logged when a plugin instance starts and summarizes its capabilities
+type StartupEvent struct {
+	Level           string    `json:"level"`
+	Msg             string    `json:"msg"`
+	Time            time.Time `json:"time"`
+	Middleware      string    `json:"middleware,omitempty"`
+	Algorithms      []string  `json:"algorithms"`
+	Issuer          string    `json:"issuer,omitempty"`
+	Audiences       []string  `json:"audiences,omitempty"`
+	StaticKeys      int       `json:"staticKeys"`
+	JwksEndpoints   int       `json:"jwksEndpoints"`
+	Opa             bool      `json:"opa"`
+	OpaFailureMode  string    `json:"opaFailureMode,omitempty"`
+	OpaCache        bool      `json:"opaCache"`
+	MagicToken      bool      `json:"magicToken"`
+	EmergencyTokens int       `json:"emergencyTokens"`
+	TrustedIdentity bool      `json:"trustedIdentity"`
+	Anonymous       bool      `json:"anonymous"`
+	ValidateExpiry  bool      `json:"validateExpiry"`
+	FaultInjection  bool      `json:"faultInjection,omitempty"`
 }
 
 type Network struct {
@@ -101,6 +592,8 @@ type JwtHeader struct {
 	Typ  string   `json:"typ"`
 	Cty  string   `json:"cty"`
 	Crit []string `json:"crit"`
+	// Signer is the ARN of the AWS load balancer which signed an ALB token
+	Signer string `json:"signer,omitempty"`
 }
 
 type JWT struct {
@@ -108,8 +601,42 @@ type JWT struct {
 	Signature []byte
 	Header    JwtHeader
 	Payload   map[string]interface{}
+	// Anonymous is set for identities synthesized for requests without a token
+	Anonymous bool
+	// KeyID is the kid of the key which verified the signature
+	KeyID string
+	// Nested is the inner token of a nested JWT (cty JWT), which carries the claims
+	Nested string
+	// Raw is the token as received in the request, the outer token of nested JWTs
+	Raw string
+}
+
+// opaUrlData holds the request attributes available to the OpaUrl template.
+type opaUrlData struct {
+	Host   string
+	Method string
+	Path   string
+	Claims map[string]interface{}
+}
+
+// forbiddenError is returned when the request is authenticated, but not authorized.
+type forbiddenError struct {
+	msg string
+	// reason is the explanation of the denial which may be exposed to the client
+	reason string
+	// status, header and body override the response, when set
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (err *forbiddenError) Error() string {
+	return err.msg
 }
 
+// errOpaUnavailable is wrapped by the errors returned when OPA could not be queried.
+var errOpaUnavailable = errors.New("OPA unavailable")
+
 var supportedHeaderNames = map[string]struct{}{"alg": {}, "kid": {}, "typ": {}, "cty": {}, "crit": {}}
 
 // Key is a JSON web key returned by the JWKS request.
@@ -151,8 +678,39 @@ type PayloadInput struct {
 	JWTPayload map[string]interface{} `json:"tokenPayload"`
 	Body       map[string]interface{} `json:"body,omitempty"`
 	Form       url.Values             `json:"form,omitempty"`
+	// BodyTruncated is set when the body exceeds the OpaBodyLimit and was not parsed
+	BodyTruncated bool `json:"bodyTruncated,omitempty"`
+	// RawBody is the body of other content types, when enabled by OpaRawBody
+	RawBody  string         `json:"rawBody,omitempty"`
+	Upstream *UpstreamInput `json:"upstream,omitempty"`
+	// Metadata describes the deployment, as configured by OpaMetadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Client is the address of the client, taken from X-Forwarded-For when present
+	Client *Client `json:"client,omitempty"`
+	// Middleware is the name of the Traefik middleware
+	Middleware string `json:"middleware,omitempty"`
+	// Token is the bearer token of the request, when enabled by OpaIncludeToken
+	Token string `json:"token,omitempty"`
+}
+
+// UpstreamInput contains what earlier middlewares in the chain decided
+type UpstreamInput struct {
+	Decisions []UpstreamDecision `json:"decisions,omitempty"`
+	Headers   map[string]string  `json:"headers,omitempty"`
+}
+
+// UpstreamDecision is an OPA decision of a plugin instance earlier in the chain
+type UpstreamDecision struct {
+	Source     string                     `json:"source"`
+	Middleware string                     `json:"middleware,omitempty"`
+	Allow      bool                       `json:"allow"`
+	Result     map[string]json.RawMessage `json:"result,omitempty"`
+	Claims     map[string]interface{}     `json:"claims,omitempty"`
 }
 
+// upstreamDecisionsKey is the context key of the []UpstreamDecision of earlier plugin instances
+type upstreamDecisionsKey struct{}
+
 // Payload for OPA requests
 type Payload struct {
 	Input *PayloadInput `json:"input"`
@@ -164,264 +722,2108 @@ type Response struct {
 }
 
 // New creates a new plugin
-func New(_ context.Context, next http.Handler, config *Config, _ string) (http.Handler, error) {
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	config, err := expandConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
 	jwtPlugin := &JwtPlugin{
 		next:          next,
+		name:          name,
 		opaUrl:        config.OpaUrl,
 		opaAllowField: config.OpaAllowField,
 		payloadFields: config.PayloadFields,
 		required:      config.Required,
 		alg:           config.Alg,
 		iss:           config.Iss,
-		aud:           config.Aud,
+		audiences:     config.Audiences,
 		keys:          make(map[string]interface{}),
-		jwtHeaders:    config.JwtHeaders,
 		opaHeaders:    config.OpaHeaders,
 
-		enableMagicToken: config.EnableMagicToken,
-		magicToken: config.MagicToken,
-		magicTokenForwardAuth: config.MagicTokenForwardAuth,
-		forwardAuthHeader: config.ForwardAuthHeader,
+		enableMagicToken:       config.EnableMagicToken,
+		forwardAuthHeader:      config.ForwardAuthHeader,
 		forwardAuthErrorHeader: config.ForwardAuthErrorHeader,
-		logging: config.Logging,
+
+		trustedIdentityHeader: config.TrustedIdentityHeader,
+		trustedIdentityFormat: config.TrustedIdentityFormat,
+
+		anonymousIdentity: config.AnonymousIdentity,
+		anonymousClaims:   config.AnonymousClaims,
+
+		opaRetries:            config.OpaRetries,
+		opaRetryBackoff:       100 * time.Millisecond,
+		opaAuthHeaders:        config.OpaAuthHeaders,
+		opaFailureMode:        config.OpaFailureMode,
+		opaCacheKey:           config.OpaCacheKey,
+		opaUpstreamHeaders:    config.OpaUpstreamHeaders,
+		opaIncludeBody:        config.OpaIncludeBody,
+		opaBodyTypes:          config.OpaBodyTypes,
+		opaBodyLimit:          config.OpaBodyLimit,
+		opaBodySpillThreshold: config.OpaBodySpillThreshold,
+		opaRawBody:            config.OpaRawBody,
+		opaMetadata:           config.OpaMetadata,
+		opaResponseHeaders:    config.OpaResponseHeaders,
+		opaIncludeToken:       config.OpaIncludeToken,
+
+		requestTags: config.RequestTags,
+
+		unauthorizedStatus: config.UnauthorizedStatus,
+		forbiddenStatus:    config.ForbiddenStatus,
+
+		exposeDenyReason: config.ExposeDenyReason,
+		denyReasonHeader: config.DenyReasonHeader,
+
+		proxyAuthorization: config.ProxyAuthorization,
+
+		validateExpiry:       config.ValidateExpiry,
+		serviceTokenSubjects: config.ServiceTokenSubjects,
+
+		userinfoHeader: config.UserinfoHeader,
+		userinfoClaims: config.UserinfoClaims,
+
+		envoyExtAuthz: config.EnvoyExtAuthz,
+
+		stageRules: config.StageRules,
+
+		propagateRetryAfter: config.PropagateRetryAfter,
+
+		requireClaims: config.RequireClaims,
+
+		requiredScopes: config.RequiredScopes,
+
+		requiredRoles: config.RequiredRoles,
+		rolesHeader:   config.RolesHeader,
+
+		forwardPayloadHeader: config.ForwardPayloadHeader,
+
+		errorFormat: config.ErrorFormat,
+
+		realm: config.Realm,
+
+		errorMode: config.ErrorMode,
+
+		ignorePreflight: config.IgnorePreflight,
+
+		tenants: len(config.Tenants) > 0,
+
+		allowAnonymous:   config.AllowAnonymous,
+		authStatusHeader: config.AuthStatusHeader,
+
+		tracing: config.Tracing,
+
+		auditLog: config.AuditLog,
+
+		requireTokenType: config.RequireTokenType,
+
+		preventReplay: config.PreventReplay,
+
+		requireKid: config.RequireKid,
+
+		allowedSubjects: config.AllowedSubjects,
+		deniedSubjects:  config.DeniedSubjects,
+
+		accessRules: config.AccessRules,
 	}
-	if err := jwtPlugin.ParseKeys(config.Keys); err != nil {
-		jwtPlugin.log("ERR failed to parse keys", err.Error())
-		return nil, err
+	for _, source := range config.Expressions {
+		e, err := compileExpression(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %v", source, err)
+		}
+		jwtPlugin.expressions = append(jwtPlugin.expressions, e)
 	}
-	go jwtPlugin.BackgroundRefresh()
-	jwtPlugin.log("starting with the config", jwtPlugin)
-	return jwtPlugin, nil
-}
-
-func (jwtPlugin *JwtPlugin) BackgroundRefresh() {
-	for {
-		jwtPlugin.FetchKeys()
-		time.Sleep(15 * time.Minute) // 15 min
+	for _, rule := range jwtPlugin.requireClaims {
+		if rule.Claim == "" || (len(rule.AnyOf) == 0 && rule.Equals == "") {
+			return nil, fmt.Errorf("invalid required claim %s, expecting a claim with anyOf or equals", rule.Claim)
+		}
 	}
-}
-
-func (jwtPlugin *JwtPlugin) ParseKeys(certificates []string) error {
-	for _, certificate := range certificates {
-		if block, rest := pem.Decode([]byte(certificate)); block != nil {
-			if len(rest) > 0 {
-				return fmt.Errorf("extra data after a PEM certificate block")
-			}
-			if block.Type == "CERTIFICATE" {
-				cert, err := x509.ParseCertificate(block.Bytes)
-				if err != nil {
-					return fmt.Errorf("failed to parse a PEM certificate: %v", err)
-				}
-				jwtPlugin.keys[base64.RawURLEncoding.EncodeToString(cert.SubjectKeyId)] = cert.PublicKey
-			} else if block.Type == "PUBLIC KEY" || block.Type == "RSA PUBLIC KEY" {
-				key, err := x509.ParsePKIXPublicKey(block.Bytes)
-				if err != nil {
-					return fmt.Errorf("failed to parse a PEM public key: %v", err)
-				}
-				jwtPlugin.keys[strconv.Itoa(len(jwtPlugin.keys))] = key
-			} else {
-				return fmt.Errorf("failed to extract a Key from the PEM certificate")
+	for i, accessRule := range jwtPlugin.accessRules {
+		if len(accessRule.Paths) == 0 {
+			return nil, fmt.Errorf("invalid access rule %d, expecting paths", i)
+		}
+		for _, rule := range accessRule.RequireClaims {
+			if rule.Claim == "" || (len(rule.AnyOf) == 0 && rule.Equals == "") {
+				return nil, fmt.Errorf("invalid required claim %s of access rule %d, expecting a claim with anyOf or equals", rule.Claim, i)
 			}
-		} else if u, err := url.ParseRequestURI(certificate); err == nil {
-			jwtPlugin.jwkEndpoints = append(jwtPlugin.jwkEndpoints, u)
-		} else {
-			return fmt.Errorf("Invalid configuration, expecting a certificate, public key or JWK URL")
 		}
 	}
-
-	return nil
-}
-
-func (jwtPlugin *JwtPlugin) FetchKeys() {
-	jwtPlugin.log("fetching keys from the jwk endpoints", jwtPlugin.jwkEndpoints)
-	for _, u := range jwtPlugin.jwkEndpoints {
-		response, err := http.Get(u.String())
-		if err != nil {
-			jwtPlugin.log("ERR fetching jwks", err.Error())
+	jwtHeaders := jwtHeaderRules(config.JwtHeaders, config.JwtHeaderRules)
+	for _, rule := range jwtHeaders {
+		if rule.Target != "request" && rule.Target != "response" && rule.Target != "both" {
+			return nil, fmt.Errorf("invalid target %s for JWT header %s, expecting request, response or both", rule.Target, rule.Header)
+		}
+		if rule.Mode != "append" && rule.Mode != "override" {
+			return nil, fmt.Errorf("invalid mode %s for JWT header %s, expecting append or override", rule.Mode, rule.Header)
+		}
+	}
+	var transforms []Transform
+	for _, rule := range jwtHeaders {
+		transform := Transform{Action: "copy", Header: rule.Header, Claim: rule.Claim, Target: rule.Target, Mode: rule.Mode}
+		// claims containing actions are templates composing the header from several claims
+		if strings.Contains(rule.Claim, "{{") {
+			transform.Action, transform.Claim, transform.Template = "mint", "", rule.Claim
+		}
+		transforms = append(transforms, transform)
+	}
+	transformer, err := newTransformer(append(transforms, config.Transforms...), config.ArrayClaimDelimiter)
+	if err != nil {
+		return nil, err
+	}
+	jwtPlugin.transformer = transformer
+	if config.ClockSkew != "" {
+		if jwtPlugin.clockSkew, err = time.ParseDuration(config.ClockSkew); err != nil {
+			return nil, fmt.Errorf("invalid ClockSkew: %v", err)
+		}
+		if jwtPlugin.clockSkew < 0 {
+			return nil, fmt.Errorf("invalid ClockSkew %s, expecting a positive duration", config.ClockSkew)
+		}
+	}
+	alb, err := newAlbVerifier(config.AwsAlb, jwtPlugin.clockSkew)
+	if err != nil {
+		return nil, err
+	}
+	if alb != nil {
+		jwtPlugin.assertions = append(jwtPlugin.assertions, alb)
+		jwtPlugin.assertionsExclusive = jwtPlugin.assertionsExclusive || config.AwsAlb.Exclusive
+	}
+	iap, err := newIapVerifier(config.GoogleIap, jwtPlugin.clockSkew)
+	if err != nil {
+		return nil, err
+	}
+	if iap != nil {
+		jwtPlugin.assertions = append(jwtPlugin.assertions, iap)
+		jwtPlugin.assertionsExclusive = jwtPlugin.assertionsExclusive || config.GoogleIap.Exclusive
+	}
+	if jwtPlugin.introspector, err = newIntrospector(config.Introspection, jwtPlugin.clockSkew); err != nil {
+		return nil, err
+	}
+	if jwtPlugin.tokenExchanger, err = newTokenExchanger(config.TokenExchange); err != nil {
+		return nil, err
+	}
+	if jwtPlugin.faults, err = newFaults(config.FaultInjection); err != nil {
+		return nil, err
+	}
+	if jwtPlugin.rateLimiter, err = newRateLimiter(config.RateLimit); err != nil {
+		return nil, err
+	}
+	switch jwtPlugin.errorMode {
+	case "":
+		jwtPlugin.errorMode = "terminate"
+	case "forward":
+		// forward is the former name of forward-with-error-header
+		jwtPlugin.errorMode = "forward-with-error-header"
+	case "terminate", "forward-with-error-header":
+	default:
+		return nil, fmt.Errorf("invalid ErrorMode %s, expecting terminate or forward-with-error-header", jwtPlugin.errorMode)
+	}
+	if jwtPlugin.errorMode == "forward-with-error-header" && jwtPlugin.forwardAuthErrorHeader == "" {
+		return nil, fmt.Errorf("invalid ErrorMode %s, expecting a ForwardAuthErrorHeader", jwtPlugin.errorMode)
+	}
+	switch jwtPlugin.errorFormat {
+	case "":
+		jwtPlugin.errorFormat = "plain"
+	case "plain", "json":
+	default:
+		return nil, fmt.Errorf("invalid ErrorFormat %s, expecting plain or json", jwtPlugin.errorFormat)
+	}
+	errorMessage := config.ErrorMessage
+	if errorMessage == "" {
+		errorMessage = "{{.StatusText}}"
+	}
+	if jwtPlugin.errorMessage, err = template.New("ErrorMessage").Parse(errorMessage); err != nil {
+		return nil, fmt.Errorf("invalid ErrorMessage: %v", err)
+	}
+	for _, skipPath := range config.SkipPaths {
+		if !strings.HasPrefix(skipPath, "^") {
+			jwtPlugin.skipPaths = append(jwtPlugin.skipPaths, skipPath)
 			continue
 		}
-		body, err := ioutil.ReadAll(response.Body)
+		regex, err := regexp.Compile(skipPath)
 		if err != nil {
-			jwtPlugin.log("ERR reading jwks", err.Error())
-			continue
+			return nil, fmt.Errorf("invalid skip path %s: %v", skipPath, err)
 		}
-		var jwksKeys Keys
-		err = json.Unmarshal(body, &jwksKeys)
+		jwtPlugin.skipPathRegexes = append(jwtPlugin.skipPathRegexes, regex)
+	}
+	if jwtPlugin.logLevel, err = parseLogLevel(config); err != nil {
+		return nil, err
+	}
+	jwtPlugin.identityHeaders = jwtPlugin.inboundIdentityHeaders()
+	jwtPlugin.retiredKeys = make(map[string]time.Time)
+	for kid, deadline := range config.RetiredKeys {
+		retired, err := time.Parse(time.RFC3339, deadline)
 		if err != nil {
-			jwtPlugin.log("ERR unmarshalling jwks", err.Error())
-			continue
+			return nil, fmt.Errorf("invalid deadline for retired key %s: %v", kid, err)
 		}
-		for _, key := range jwksKeys.Keys {
-			switch key.Kty {
-			case "RSA":
-				{
-					if key.Kid == "" {
-						key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.E, key.N))
-						if err != nil {
-							break
-						}
-					}
-					nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
-					if err != nil {
-						break
-					}
-					eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
-					if err != nil {
-						break
-					}
-					jwtPlugin.keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(new(big.Int).SetBytes(eBytes).Uint64())}
-				}
-			case "EC":
-				{
-					if key.Kid == "" {
-						key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, key.X, key.Y))
-						if err != nil {
-							break
-						}
-					}
-					var crv elliptic.Curve
-					switch key.Crv {
-					case "P-256":
-						crv = elliptic.P256()
-					case "P-384":
-						crv = elliptic.P384()
-					case "P-521":
-						crv = elliptic.P521()
-					default:
-						switch key.Alg {
-						case "ES256":
-							crv = elliptic.P256()
-						case "ES384":
-							crv = elliptic.P384()
-						case "ES512":
-							crv = elliptic.P521()
-						default:
-							crv = elliptic.P256()
-						}
-					}
-					xBytes, err := base64.RawURLEncoding.DecodeString(key.X)
-					if err != nil {
-						break
-					}
-					yBytes, err := base64.RawURLEncoding.DecodeString(key.Y)
-					if err != nil {
-						break
-					}
-					jwtPlugin.keys[key.Kid] = &ecdsa.PublicKey{Curve: crv, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
-				}
-			case "oct":
-				{
-					kBytes, err := base64.RawURLEncoding.DecodeString(key.K)
-					if err != nil {
-						break
-					}
-					if key.Kid == "" {
-						key.Kid, err = JWKThumbprint(key.K)
-						if err != nil {
-							break
-						}
-					}
-					jwtPlugin.keys[key.Kid] = kBytes
+		jwtPlugin.retiredKeys[kid] = retired
+	}
+	if config.Aud != "" {
+		jwtPlugin.audiences = append([]string{config.Aud}, jwtPlugin.audiences...)
+	}
+	if jwtPlugin.unauthorizedStatus == 0 {
+		jwtPlugin.unauthorizedStatus = http.StatusUnauthorized
+	}
+	if jwtPlugin.forbiddenStatus == 0 {
+		jwtPlugin.forbiddenStatus = http.StatusForbidden
+	}
+	if !isErrorStatus(jwtPlugin.unauthorizedStatus) {
+		return nil, fmt.Errorf("invalid UnauthorizedStatus %d, expecting a 4xx or 5xx status", jwtPlugin.unauthorizedStatus)
+	}
+	if !isErrorStatus(jwtPlugin.forbiddenStatus) {
+		return nil, fmt.Errorf("invalid ForbiddenStatus %d, expecting a 4xx or 5xx status", jwtPlugin.forbiddenStatus)
+	}
+	switch jwtPlugin.trustedIdentityFormat {
+	case "":
+		jwtPlugin.trustedIdentityFormat = "plain"
+	case "plain", "json", "jwt":
+	default:
+		return nil, fmt.Errorf("invalid TrustedIdentityFormat %s, expecting plain, json or jwt", jwtPlugin.trustedIdentityFormat)
+	}
+	for _, sourceRange := range config.TrustedIdentitySourceRanges {
+		_, network, err := net.ParseCIDR(sourceRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TrustedIdentitySourceRanges: %v", err)
+		}
+		jwtPlugin.trustedIdentitySourceRanges = append(jwtPlugin.trustedIdentitySourceRanges, network)
+	}
+	// unsigned identities can be asserted by any client which reaches the plugin
+	if jwtPlugin.trustedIdentityHeader != "" && jwtPlugin.trustedIdentityFormat != "jwt" && len(jwtPlugin.trustedIdentitySourceRanges) == 0 {
+		return nil, fmt.Errorf("invalid TrustedIdentityFormat %s, expecting TrustedIdentitySourceRanges", jwtPlugin.trustedIdentityFormat)
+	}
+	opaTimeout := 10 * time.Second
+	if config.OpaTimeout != "" {
+		var err error
+		if opaTimeout, err = time.ParseDuration(config.OpaTimeout); err != nil {
+			return nil, fmt.Errorf("invalid OpaTimeout: %v", err)
+		}
+	}
+	switch jwtPlugin.opaFailureMode {
+	case "":
+		jwtPlugin.opaFailureMode = "closed"
+	case "closed", "open", "open-readonly":
+	default:
+		return nil, fmt.Errorf("invalid OpaFailureMode %s, expecting closed, open or open-readonly", jwtPlugin.opaFailureMode)
+	}
+	switch jwtPlugin.opaRawBody {
+	case "", "string", "base64":
+	default:
+		return nil, fmt.Errorf("invalid OpaRawBody %s, expecting string or base64", jwtPlugin.opaRawBody)
+	}
+	if config.OpaRetryBackoff != "" {
+		var err error
+		if jwtPlugin.opaRetryBackoff, err = time.ParseDuration(config.OpaRetryBackoff); err != nil {
+			return nil, fmt.Errorf("invalid OpaRetryBackoff: %v", err)
+		}
+	}
+	if config.OpaCacheTTL != "" {
+		ttl, err := time.ParseDuration(config.OpaCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpaCacheTTL: %v", err)
+		}
+		if len(jwtPlugin.opaCacheKey) == 0 {
+			jwtPlugin.opaCacheKey = []string{"sub", "method", "host", "path", "query"}
+		}
+		for _, element := range jwtPlugin.opaCacheKey {
+			if !validCacheKeyElement(element) {
+				return nil, fmt.Errorf("invalid OpaCacheKey element %s", element)
+			}
+		}
+		jwtPlugin.opaCache = newDecisionCache(ttl, config.OpaCacheSize)
+	}
+	if strings.Contains(jwtPlugin.opaUrl, "{{") {
+		funcs := template.FuncMap{"pathEscape": url.PathEscape, "queryEscape": url.QueryEscape}
+		opaUrlTemplate, err := template.New("OpaUrl").Funcs(funcs).Option("missingkey=zero").Parse(jwtPlugin.opaUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpaUrl template: %v", err)
+		}
+		jwtPlugin.opaUrlTemplate = opaUrlTemplate
+		// the text outside of the actions, for checking the expanded URLs
+		jwtPlugin.opaUrlStatic = templateActions.ReplaceAllString(jwtPlugin.opaUrl, "")
+	}
+	if config.OpaResultSchema != "" {
+		var err error
+		if jwtPlugin.opaResultSchema, err = newJSONSchema(config.OpaResultSchema); err != nil {
+			return nil, fmt.Errorf("invalid OpaResultSchema: %v", err)
+		}
+	}
+	if config.DenyPage != "" {
+		var err error
+		if jwtPlugin.denyPage, err = newDenyPage(config.DenyPage, config.DenyPageTranslations); err != nil {
+			return nil, err
+		}
+	}
+	opaTLSConfig, err := newTLSConfig(config.OpaClientCert, config.OpaClientKey, config.OpaCaCert)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPA TLS configuration: %v", err)
+	}
+	opaMaxIdleConns := config.OpaMaxIdleConns
+	if opaMaxIdleConns <= 0 {
+		opaMaxIdleConns = 100
+	}
+	jwtPlugin.opaClient = newHTTPClient(opaTimeout, opaTLSConfig, opaMaxIdleConns)
+	jwksTimeout := 10 * time.Second
+	if config.JwksTimeout != "" {
+		if jwksTimeout, err = time.ParseDuration(config.JwksTimeout); err != nil {
+			return nil, fmt.Errorf("invalid JwksTimeout: %v", err)
+		}
+	}
+	jwtPlugin.jwksClient = newHTTPClient(jwksTimeout, nil, 2)
+	if config.MaxTokenLifetime != "" {
+		if jwtPlugin.maxTokenLifetime, err = time.ParseDuration(config.MaxTokenLifetime); err != nil {
+			return nil, fmt.Errorf("invalid MaxTokenLifetime: %v", err)
+		}
+	}
+	revocationInterval := time.Minute
+	if config.RevocationInterval != "" {
+		if revocationInterval, err = time.ParseDuration(config.RevocationInterval); err != nil {
+			return nil, fmt.Errorf("invalid RevocationInterval: %v", err)
+		}
+		if revocationInterval <= 0 {
+			return nil, fmt.Errorf("invalid RevocationInterval %s, expecting a positive duration", config.RevocationInterval)
+		}
+	}
+	if config.RevocationUrl != "" {
+		if jwtPlugin.revocations, err = newRevocations(config.RevocationUrl, jwtPlugin.jwksClient); err != nil {
+			return nil, err
+		}
+	}
+	keyFilesInterval := time.Minute
+	if config.KeyFilesInterval != "" {
+		if keyFilesInterval, err = time.ParseDuration(config.KeyFilesInterval); err != nil {
+			return nil, fmt.Errorf("invalid KeyFilesInterval: %v", err)
+		}
+	}
+	if jwtPlugin.preventReplay {
+		jwtPlugin.replayStore = newMemoryReplayStore(config.ReplayCacheSize)
+	}
+	if !config.DisableVerificationCache {
+		jwtPlugin.verificationCache = newVerificationCache(config.VerificationCacheSize)
+	}
+	if config.DecisionLogUrl != "" {
+		if jwtPlugin.decisionLog, err = newDecisionLog(jwtPlugin, config.DecisionLogUrl); err != nil {
+			return nil, err
+		}
+	}
+	magicTokens := config.MagicTokens
+	if config.MagicToken != "" {
+		magicTokens = append([]MagicToken{{Token: config.MagicToken, ForwardAuth: config.MagicTokenForwardAuth}}, magicTokens...)
+	}
+	for i, token := range magicTokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("invalid magic token %d, expecting a token", i)
+		}
+		hash := sha256.Sum256([]byte(token.Token))
+		magic := magicToken{hash: hash[:], forwardAuth: token.ForwardAuth}
+		if token.Expires != "" {
+			if magic.expires, err = time.Parse(time.RFC3339, token.Expires); err != nil {
+				return nil, fmt.Errorf("invalid expiry for magic token %d: %v", i, err)
+			}
+		}
+		for _, sourceRange := range token.SourceRanges {
+			_, network, err := net.ParseCIDR(sourceRange)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source range for magic token %d: %v", i, err)
+			}
+			magic.sourceRanges = append(magic.sourceRanges, network)
+		}
+		jwtPlugin.magicTokens = append(jwtPlugin.magicTokens, magic)
+	}
+	for i, rule := range config.NetworkRules {
+		if rule.Claim == "" || len(rule.AnyOf) == 0 || len(rule.SourceRanges) == 0 {
+			return nil, fmt.Errorf("invalid network rule %d, expecting a claim with anyOf and sourceRanges", i)
+		}
+		networkRule := networkRule{claim: rule.Claim, anyOf: rule.AnyOf}
+		for _, sourceRange := range rule.SourceRanges {
+			_, network, err := net.ParseCIDR(sourceRange)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source range for network rule %d: %v", i, err)
+			}
+			networkRule.sourceRanges = append(networkRule.sourceRanges, network)
+		}
+		jwtPlugin.networkRules = append(jwtPlugin.networkRules, networkRule)
+	}
+	for _, token := range config.EmergencyTokens {
+		hash, err := hex.DecodeString(token.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid hash for emergency token %s, expecting a hex encoded SHA-256 hash", token.Name)
+		}
+		expires, err := time.Parse(time.RFC3339, token.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry for emergency token %s: %v", token.Name, err)
+		}
+		jwtPlugin.emergencyTokens = append(jwtPlugin.emergencyTokens, emergencyToken{name: token.Name, hash: hash, expires: expires, paths: token.Paths})
+	}
+	if err := jwtPlugin.ParseKeys(config.Keys); err != nil {
+		jwtPlugin.logf("error", "failed to parse keys: %v", err)
+		return nil, err
+	}
+	for _, secret := range config.HmacSecrets {
+		kid, secret, err := jwtPlugin.staticKid(secret)
+		if err != nil {
+			return nil, err
+		}
+		key, err := hmacSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		jwtPlugin.setKey(kid, key)
+	}
+	for _, override := range hostOverrides(config) {
+		plugin, err := New(ctx, next, overrideConfig(config, override), name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid override of hosts %v: %v", override.Hosts, err)
+		}
+		// the overrides ship their decisions through the sink of the plugin, and share its seen tokens
+		plugin.(*JwtPlugin).decisionLog = jwtPlugin.decisionLog
+		plugin.(*JwtPlugin).replayStore = jwtPlugin.replayStore
+		plugin.(*JwtPlugin).revocations = jwtPlugin.revocations
+		jwtPlugin.hostPlugins = append(jwtPlugin.hostPlugins, hostPlugin{hosts: override.Hosts, plugin: plugin})
+	}
+	go jwtPlugin.BackgroundRefresh()
+	if len(jwtPlugin.keyFiles) > 0 && keyFilesInterval > 0 {
+		go jwtPlugin.watchKeyFiles(keyFilesInterval)
+	}
+	if jwtPlugin.revocations != nil {
+		go jwtPlugin.watchRevocations(revocationInterval)
+	}
+	jwtPlugin.logStartup()
+	return jwtPlugin, nil
+}
+
+// envVariable matches the ${NAME} references to environment variables in configuration values.
+var envVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${NAME} references in the value by the environment variables, which must be set.
+func expandEnv(field string, value string) (string, error) {
+	var err error
+	expanded := envVariable.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envVariable.FindStringSubmatch(reference)[1]
+		variable, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("invalid %s, environment variable %s is not set", field, name)
+		}
+		return variable
+	})
+	return expanded, err
+}
+
+// expandConfig returns a copy of the configuration with the environment variables expanded in the Keys,
+// HmacSecrets, OpaUrl, MagicToken, MagicTokenForwardAuth, MagicTokens, OpaAuthHeaders and the client secrets of Introspection and TokenExchange, so secrets can be kept out of the
+// dynamic configuration.
+func expandConfig(config *Config) (*Config, error) {
+	expanded := *config
+	var err error
+	expanded.Keys = make([]string, len(config.Keys))
+	for i, key := range config.Keys {
+		if expanded.Keys[i], err = expandEnv("Keys", key); err != nil {
+			return nil, err
+		}
+	}
+	expanded.HmacSecrets = make([]string, len(config.HmacSecrets))
+	for i, secret := range config.HmacSecrets {
+		if expanded.HmacSecrets[i], err = expandEnv("HmacSecrets", secret); err != nil {
+			return nil, err
+		}
+	}
+	if expanded.OpaUrl, err = expandEnv("OpaUrl", config.OpaUrl); err != nil {
+		return nil, err
+	}
+	if expanded.MagicToken, err = expandEnv("MagicToken", config.MagicToken); err != nil {
+		return nil, err
+	}
+	if expanded.MagicTokenForwardAuth, err = expandEnv("MagicTokenForwardAuth", config.MagicTokenForwardAuth); err != nil {
+		return nil, err
+	}
+	expanded.MagicTokens = make([]MagicToken, len(config.MagicTokens))
+	for i, token := range config.MagicTokens {
+		expanded.MagicTokens[i] = token
+		if expanded.MagicTokens[i].Token, err = expandEnv("MagicTokens", token.Token); err != nil {
+			return nil, err
+		}
+		if expanded.MagicTokens[i].ForwardAuth, err = expandEnv("MagicTokens", token.ForwardAuth); err != nil {
+			return nil, err
+		}
+	}
+	if expanded.Introspection.ClientSecret, err = expandEnv("Introspection.ClientSecret", config.Introspection.ClientSecret); err != nil {
+		return nil, err
+	}
+	if expanded.TokenExchange.ClientSecret, err = expandEnv("TokenExchange.ClientSecret", config.TokenExchange.ClientSecret); err != nil {
+		return nil, err
+	}
+	if config.OpaAuthHeaders != nil {
+		expanded.OpaAuthHeaders = make(map[string]string, len(config.OpaAuthHeaders))
+		for header, value := range config.OpaAuthHeaders {
+			if expanded.OpaAuthHeaders[header], err = expandEnv("OpaAuthHeaders", value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &expanded, nil
+}
+
+// hostOverrides returns the HostOverrides, followed by the overrides of the Tenants sorted by host.
+func hostOverrides(config *Config) []HostOverride {
+	overrides := make([]HostOverride, 0, len(config.HostOverrides)+len(config.Tenants))
+	overrides = append(overrides, config.HostOverrides...)
+	hosts := make([]string, 0, len(config.Tenants))
+	for host := range config.Tenants {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		tenant := config.Tenants[host]
+		override := HostOverride{Hosts: []string{host}, Iss: tenant.Iss, Audiences: tenant.Audiences}
+		if tenant.JwksUrl != "" {
+			override.Keys = []string{tenant.JwksUrl}
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides
+}
+
+// overrideConfig returns a copy of the configuration with the settings of the override.
+func overrideConfig(config *Config, override HostOverride) *Config {
+	overridden := *config
+	overridden.HostOverrides = nil
+	overridden.Tenants = nil
+	overridden.DecisionLogUrl = ""
+	overridden.RevocationUrl = ""
+	if len(override.Keys) > 0 {
+		overridden.Keys = override.Keys
+	}
+	if override.Iss != "" {
+		overridden.Iss = override.Iss
+	}
+	if len(override.Audiences) > 0 {
+		overridden.Aud = ""
+		overridden.Audiences = override.Audiences
+	}
+	if override.OpaUrl != "" {
+		overridden.OpaUrl = override.OpaUrl
+	}
+	if override.OpaAllowField != "" {
+		overridden.OpaAllowField = override.OpaAllowField
+	}
+	if len(override.RequireClaims) > 0 {
+		overridden.RequireClaims = override.RequireClaims
+	}
+	if len(override.RequiredScopes) > 0 {
+		overridden.RequiredScopes = override.RequiredScopes
+	}
+	return &overridden
+}
+
+// hostPlugin returns the plugin of the first HostOverride matching the host of the request, or nil.
+func (jwtPlugin *JwtPlugin) hostPlugin(request *http.Request) http.Handler {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, override := range jwtPlugin.hostPlugins {
+		for _, pattern := range override.hosts {
+			pattern = strings.ToLower(pattern)
+			if pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+				return override.plugin
+			}
+		}
+	}
+	return nil
+}
+
+// newTLSConfig creates the TLS configuration for outbound requests. The client certificate,
+// key and CA bundle are PEM encoded values or paths to PEM files. Returns nil when nothing is configured.
+func newTLSConfig(clientCert string, clientKey string, caCert string) (*tls.Config, error) {
+	if clientCert == "" && clientKey == "" && caCert == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCert != "" || clientKey != "" {
+		certPEM, err := readPEM(clientCert)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := readPEM(clientKey)
+		if err != nil {
+			return nil, err
+		}
+		certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if caCert != "" {
+		caPEM, err := readPEM(caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in the CA bundle")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// newHTTPClient creates a client for a single destination, which keeps up to maxIdleConns connections alive.
+func newHTTPClient(timeout time.Duration, tlsConfig *tls.Config, maxIdleConns int) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// readPEM returns the value itself when it contains PEM data, otherwise the value is the path of a PEM file.
+func readPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// jwtHeaderRules merges the JwtHeaders map (which adds to the upstream request) with the JwtHeaderRules.
+func jwtHeaderRules(jwtHeaders map[string]string, rules []JwtHeaderRule) []JwtHeaderRule {
+	var merged []JwtHeaderRule
+	for header, claim := range jwtHeaders {
+		merged = append(merged, JwtHeaderRule{Header: header, Claim: claim})
+	}
+	// map iteration order is random, keep the headers in a predictable order
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Header < merged[j].Header })
+	merged = append(merged, rules...)
+	for i := range merged {
+		if merged[i].Target == "" {
+			merged[i].Target = "request"
+		}
+		if merged[i].Mode == "" {
+			merged[i].Mode = "append"
+		}
+	}
+	return merged
+}
+
+func (jwtPlugin *JwtPlugin) BackgroundRefresh() {
+	jwtPlugin.FetchKeys()
+	for {
+		time.Sleep(15 * time.Minute) // 15 min
+		if jwtPlugin.faults.staleJwks() {
+			jwtPlugin.logf("warn", "fault injection: skipping the refresh of the jwk endpoints")
+			continue
+		}
+		jwtPlugin.FetchKeys()
+	}
+}
+
+// AddKey registers a key for verifying tokens with the given kid, replacing an existing key with the same kid.
+// Supported keys are *rsa.PublicKey, *ecdsa.PublicKey and []byte (symmetric keys). It is safe for concurrent use,
+// which allows applications embedding the plugin to push keys from their own control plane.
+func (jwtPlugin *JwtPlugin) AddKey(kid string, key interface{}) error {
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, []byte:
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	jwtPlugin.setKey(kid, key)
+	return nil
+}
+
+// RemoveKey removes the key with the given kid. Keys of JWK endpoints are added again by the next refresh.
+func (jwtPlugin *JwtPlugin) RemoveKey(kid string) {
+	jwtPlugin.keysLock.Lock()
+	defer jwtPlugin.keysLock.Unlock()
+	delete(jwtPlugin.keys, kid)
+	jwtPlugin.keysGeneration++
+}
+
+func (jwtPlugin *JwtPlugin) setKey(kid string, key interface{}) {
+	jwtPlugin.keysLock.Lock()
+	defer jwtPlugin.keysLock.Unlock()
+	jwtPlugin.keys[kid] = key
+	jwtPlugin.keysGeneration++
+}
+
+// hasKey tells whether a key with the kid is known.
+func (jwtPlugin *JwtPlugin) hasKey(kid string) bool {
+	jwtPlugin.keysLock.RLock()
+	defer jwtPlugin.keysLock.RUnlock()
+	_, ok := jwtPlugin.keys[kid]
+	return ok
+}
+
+// keyGeneration counts the changes of the keys, for invalidating the verificationCache.
+func (jwtPlugin *JwtPlugin) keyGeneration() uint64 {
+	jwtPlugin.keysLock.RLock()
+	defer jwtPlugin.keysLock.RUnlock()
+	return jwtPlugin.keysGeneration
+}
+
+func (jwtPlugin *JwtPlugin) keyCount() int {
+	jwtPlugin.keysLock.RLock()
+	defer jwtPlugin.keysLock.RUnlock()
+	return len(jwtPlugin.keys)
+}
+
+func (jwtPlugin *JwtPlugin) ParseKeys(certificates []string) error {
+	for _, certificate := range certificates {
+		kid, certificate, err := jwtPlugin.staticKid(certificate)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode([]byte(certificate)); block != nil || strings.HasPrefix(strings.TrimSpace(certificate), "{") {
+			keys, err := parseKeyDocument([]byte(certificate), kid)
+			if err != nil {
+				return err
+			}
+			for kid, key := range keys {
+				// e.g. certificates with the same subject key ID
+				if jwtPlugin.hasKey(kid) {
+					return fmt.Errorf("duplicate kid %s in the Keys", kid)
+				}
+				jwtPlugin.setKey(kid, key)
+			}
+		} else if strings.HasPrefix(certificate, "file://") {
+			// keys mounted from files, e.g. Kubernetes secrets
+			file := &keyFile{path: strings.TrimPrefix(certificate, "file://"), publicKid: kid}
+			if err := jwtPlugin.loadKeyFile(file); err != nil {
+				return err
+			}
+			jwtPlugin.keyFiles = append(jwtPlugin.keyFiles, file)
+		} else if u, err := url.ParseRequestURI(certificate); err == nil {
+			jwtPlugin.jwkEndpoints = append(jwtPlugin.jwkEndpoints, u)
+			if jwtPlugin.jwksThrottles == nil {
+				jwtPlugin.jwksThrottles = make(map[string]*throttle)
+			}
+			jwtPlugin.jwksThrottles[u.String()] = &throttle{}
+		} else {
+			return fmt.Errorf("Invalid configuration, expecting a certificate, public key, JWK, JWKS, key file or JWK URL")
+		}
+	}
+
+	return nil
+}
+
+// staticKid splits the kid off an entry of the form kid=name:value, so static keys are found by the kid of
+// tokens. Entries without a kid get a sequential number.
+func (jwtPlugin *JwtPlugin) staticKid(entry string) (string, string, error) {
+	kid, value, err := splitKid(entry)
+	if kid == "" && err == nil {
+		kid = strconv.Itoa(jwtPlugin.keyCount())
+	}
+	return kid, value, err
+}
+
+// splitKid splits the kid off an entry of the form kid=name:value, the kid is empty for other entries.
+func splitKid(entry string) (string, string, error) {
+	if !strings.HasPrefix(entry, "kid=") {
+		return "", entry, nil
+	}
+	separator := strings.Index(entry, ":")
+	if separator <= len("kid=") {
+		return "", "", fmt.Errorf("invalid key entry, expecting kid=name:value")
+	}
+	return entry[len("kid="):separator], entry[separator+1:], nil
+}
+
+// parsePEMKeys returns the keys of the PEM blocks, e.g. a certificate chain or concatenated public keys.
+// Certificates are identified by their subject key ID, public keys by the given kid, followed by -1, -2...
+// for further public keys. Only the leaf, the first certificate of a chain, is loaded, the keys of the
+// issuing CAs don't sign tokens.
+func parsePEMKeys(data []byte, publicKid string) (map[string]interface{}, error) {
+	keys := make(map[string]interface{})
+	publicKeys := 0
+	leaf := false
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" && leaf {
+			data = rest
+			continue
+		}
+		kid := publicKid
+		if publicKeys > 0 {
+			kid = fmt.Sprintf("%s-%d", publicKid, publicKeys)
+		}
+		kid, key, err := parsePEMBlock(block, kid)
+		if err != nil {
+			return nil, err
+		}
+		if block.Type == "CERTIFICATE" {
+			leaf = true
+		} else {
+			publicKeys++
+		}
+		keys[kid] = key
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("failed to find a PEM block")
+	}
+	if len(strings.TrimSpace(string(data))) > 0 {
+		return nil, fmt.Errorf("extra data after a PEM certificate block")
+	}
+	return keys, nil
+}
+
+// parsePEMBlock returns the kid and key of a PEM certificate or public key. Certificates are identified by
+// their subject key ID, public keys by the given kid.
+func parsePEMBlock(block *pem.Block, kid string) (string, interface{}, error) {
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse a PEM certificate: %v", err)
+		}
+		if len(cert.SubjectKeyId) == 0 {
+			return "", nil, fmt.Errorf("PEM certificate %s has no subject key ID", cert.Subject)
+		}
+		return base64.RawURLEncoding.EncodeToString(cert.SubjectKeyId), cert.PublicKey, nil
+	} else if block.Type == "PUBLIC KEY" {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse a PEM public key: %v", err)
+		}
+		return kid, key, nil
+	} else if block.Type == "RSA PUBLIC KEY" {
+		// PKCS#1, as written by openssl rsa -RSAPublicKey_out
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			// some tools label PKIX keys as RSA PUBLIC KEY
+			pkixKey, pkixErr := x509.ParsePKIXPublicKey(block.Bytes)
+			if pkixErr != nil {
+				return "", nil, fmt.Errorf("failed to parse a PEM RSA public key: %v", err)
+			}
+			return kid, pkixKey, nil
+		}
+		return kid, key, nil
+	}
+	return "", nil, fmt.Errorf("failed to extract a Key from the PEM certificate")
+}
+
+func (jwtPlugin *JwtPlugin) FetchKeys() {
+	jwtPlugin.logf("debug", "fetching keys from the jwk endpoints %v", jwtPlugin.jwkEndpoints)
+	for _, u := range jwtPlugin.jwkEndpoints {
+		jwksThrottle := jwtPlugin.jwksThrottles[u.String()]
+		if wait := jwksThrottle.remaining(); wait > 0 {
+			jwtPlugin.logf("debug", "skipping throttled jwk endpoint %s for %s", u, wait)
+			continue
+		}
+		response, err := jwtPlugin.jwksClient.Get(u.String())
+		if err != nil {
+			jwtPlugin.logf("error", "fetching jwks: %v", err)
+			continue
+		}
+		if wait, ok := retryAfter(response); ok {
+			response.Body.Close()
+			jwksThrottle.backoff(wait)
+			jwtPlugin.logf("warn", "jwk endpoint %s throttled for %s", u, wait)
+			continue
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			jwtPlugin.logf("error", "reading jwks: %v", err)
+			continue
+		}
+		var jwksKeys Keys
+		err = json.Unmarshal(body, &jwksKeys)
+		if err != nil {
+			jwtPlugin.logf("error", "unmarshalling jwks: %v", err)
+			continue
+		}
+		for _, key := range jwksKeys.Keys {
+			kid, k, err := jwkKey(key)
+			if err != nil {
+				jwtPlugin.logf("warn", "skipping key of jwks: %v", err)
+				continue
+			}
+			jwtPlugin.setKey(kid, k)
+		}
+	}
+	jwtPlugin.logf("debug", "fetching keys finished. Number of keys is now: %d", jwtPlugin.keyCount())
+}
+
+// hmacSecret returns the key of a shared secret of the HmacSecrets, which is base64 encoded when prefixed with base64:
+func hmacSecret(secret string) ([]byte, error) {
+	if strings.HasPrefix(secret, "base64:") {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, "base64:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 encoded HMAC secret: %v", err)
+		}
+		return key, nil
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("invalid HMAC secret, expecting a non-empty value")
+	}
+	return []byte(secret), nil
+}
+
+// jwkKey returns the kid and key of a JSON web key, keys without a kid are identified by their thumbprint.
+func jwkKey(key Key) (string, interface{}, error) {
+	var err error
+	switch key.Kty {
+	case "RSA":
+		if key.Kid == "" {
+			key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.E, key.N))
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid modulus of RSA key %s: %v", key.Kid, err)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid exponent of RSA key %s: %v", key.Kid, err)
+		}
+		return key.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(new(big.Int).SetBytes(eBytes).Uint64())}, nil
+	case "EC":
+		if key.Kid == "" {
+			key.Kid, err = JWKThumbprint(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, key.X, key.Y))
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		var crv elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			crv = elliptic.P256()
+		case "P-384":
+			crv = elliptic.P384()
+		case "P-521":
+			crv = elliptic.P521()
+		default:
+			switch key.Alg {
+			case "ES256":
+				crv = elliptic.P256()
+			case "ES384":
+				crv = elliptic.P384()
+			case "ES512":
+				crv = elliptic.P521()
+			default:
+				crv = elliptic.P256()
+			}
+		}
+		xBytes, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid x coordinate of EC key %s: %v", key.Kid, err)
+		}
+		yBytes, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid y coordinate of EC key %s: %v", key.Kid, err)
+		}
+		return key.Kid, &ecdsa.PublicKey{Curve: crv, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}, nil
+	case "oct":
+		kBytes, err := base64.RawURLEncoding.DecodeString(key.K)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid symmetric key %s: %v", key.Kid, err)
+		}
+		if key.Kid == "" {
+			key.Kid, err = JWKThumbprint(key.K)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		return key.Kid, kBytes, nil
+	}
+	return "", nil, fmt.Errorf("unrecognized key type %s", key.Kty)
+}
+
+// parseJWKs returns the keys of a JWKS document, or of a single JWK, by kid.
+func parseJWKs(data []byte) (map[string]interface{}, error) {
+	var jwks Keys
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse the JWK: %v", err)
+	}
+	if jwks.Keys == nil {
+		var key Key
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("failed to parse the JWK: %v", err)
+		}
+		jwks.Keys = []Key{key}
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		kid, k, err := jwkKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keys[kid] = k
+	}
+	return keys, nil
+}
+
+// parseKeyDocument returns the keys of an inline or file key: a JWK, a JWKS or PEM certificates and
+// public keys, which are identified by the given kid.
+func parseKeyDocument(data []byte, publicKid string) (map[string]interface{}, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return parseJWKs(data)
+	}
+	return parsePEMKeys(data, publicKid)
+}
+
+func (jwtPlugin *JwtPlugin) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
+	if plugin := jwtPlugin.hostPlugin(request); plugin != nil {
+		plugin.ServeHTTP(rw, request)
+		return
+	}
+	start := time.Now()
+	jwtPlugin.logf("debug", "ServeHTTP received request")
+	token := jwtPlugin.authorization(request)
+	for _, header := range jwtPlugin.identityHeaders {
+		request.Header.Del(header)
+	}
+	record := jwtPlugin.newRequestRecord(request)
+	if jwtPlugin.skipPath(request.URL.Path) {
+		jwtPlugin.logf("debug", "skipping authentication of path %s", request.URL.Path)
+		jwtPlugin.audit(request, nil, "allow", "skipped path")
+		jwtPlugin.next.ServeHTTP(rw, request)
+		return
+	}
+	// browsers don't send credentials with CORS preflight requests
+	if jwtPlugin.ignorePreflight && request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+		jwtPlugin.logf("debug", "skipping authentication of preflight request")
+		jwtPlugin.audit(request, nil, "allow", "preflight request")
+		jwtPlugin.next.ServeHTTP(rw, request)
+		return
+	}
+	token = strings.TrimSpace(token)
+	token = strings.Replace(token, "Bearer ", "", 1)
+	// if magic token mode is enable, which is for testing tools to bypass auth with a fake user
+	// then skip the auth check stage and forward on a mocked token
+	if jwtPlugin.enableMagicToken {
+		// check if magic token set
+		if magic := jwtPlugin.matchMagicToken(request, token); magic != nil {
+			jwtPlugin.logf("debug", "bearer token matched magic token. %s=%s", jwtPlugin.forwardAuthHeader, magic.forwardAuth)
+			// remove Authorization header from original request
+			request.Header.Del(jwtPlugin.forwardAuthErrorHeader)
+			jwtPlugin.stripProxyAuthorization(request)
+			request.Header.Set(jwtPlugin.forwardAuthHeader, magic.forwardAuth)
+			jwtPlugin.audit(request, nil, "allow", "magic token")
+			jwtPlugin.next.ServeHTTP(rw, request)
+			jwtPlugin.logLatency(start, nil)
+			return
+		}
+	}
+	if len(jwtPlugin.emergencyTokens) > 0 && jwtPlugin.checkEmergencyToken(request, token) {
+		request.Header.Del(jwtPlugin.forwardAuthErrorHeader)
+		jwtPlugin.stripProxyAuthorization(request)
+		jwtPlugin.audit(request, nil, "allow", "emergency token")
+		jwtPlugin.next.ServeHTTP(rw, request)
+		jwtPlugin.logLatency(start, nil)
+		return
+	}
+
+	if err := jwtPlugin.checkToken(request, rw.Header(), record); err != nil {
+		if jwtPlugin.errorMode == "forward-with-error-header" {
+			jwtPlugin.audit(request, record, "deny", err.Error())
+			errMsg := fmt.Sprintf("token validation failed: %s", err.Error())
+			jwtPlugin.logf("debug", "%s, forwarding the request with the error in %s", errMsg, jwtPlugin.forwardAuthErrorHeader)
+			jwtPlugin.forwardError(rw, errMsg, request)
+			jwtPlugin.logLatency(start, record)
+			return
+		}
+		status := jwtPlugin.unauthorizedStatus
+		var body []byte
+		reason := ""
+		var forbidden *forbiddenError
+		if errors.As(err, &forbidden) {
+			status = jwtPlugin.forbiddenStatus
+			if jwtPlugin.exposeDenyReason && forbidden.reason != "" {
+				reason = forbidden.reason
+				if jwtPlugin.denyReasonHeader != "" {
+					rw.Header().Set(jwtPlugin.denyReasonHeader, forbidden.reason)
+				} else {
+					rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					body = []byte(forbidden.reason)
+				}
+			}
+			if forbidden.status != 0 {
+				status = forbidden.status
+			}
+			for k := range forbidden.header {
+				rw.Header().Set(k, forbidden.header.Get(k))
+			}
+			if forbidden.body != nil {
+				body = forbidden.body
+			}
+		} else if jwtPlugin.envoyExtAuthz && errors.Is(err, errOpaUnavailable) {
+			// Envoy denies requests when the authorization server is unavailable
+			status = jwtPlugin.forbiddenStatus
+		} else if !errors.Is(err, errOpaUnavailable) {
+			rw.Header().Set("WWW-Authenticate", jwtPlugin.bearerChallenge(token, err))
+		}
+		var throttled *throttledError
+		if jwtPlugin.propagateRetryAfter && errors.As(err, &throttled) {
+			status = http.StatusServiceUnavailable
+			rw.Header().Set("Retry-After", retryAfterSeconds(throttled.retryAfter))
+		}
+		if jwtPlugin.errorFormat == "json" && (forbidden == nil || forbidden.body == nil) {
+			document, err := jwtPlugin.errorDocument(request, status, reason)
+			if err == nil {
+				rw.Header().Set("Content-Type", "application/json")
+				body = document
+			} else {
+				jwtPlugin.logf("error", "rendering error document: %v", err)
+			}
+		}
+		if jwtPlugin.denyPage != nil && acceptsHTML(request) {
+			page, err := jwtPlugin.denyPage.render(request, status, reason)
+			if err == nil {
+				rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+				body = page
+			} else {
+				jwtPlugin.logf("error", "rendering deny page: %v", err)
+			}
+		}
+		jwtPlugin.audit(request, record, "deny", err.Error())
+		errMsg := fmt.Sprintf("token validation failed: %s", err.Error())
+		jwtPlugin.logf("debug", "%s", errMsg)
+		jwtPlugin.writeError(rw, errMsg, status, body)
+		jwtPlugin.logLatency(start, record)
+		return
+	}
+	jwtPlugin.audit(request, record, "allow", "")
+	request.Header.Del(jwtPlugin.forwardAuthErrorHeader)
+	jwtPlugin.stripProxyAuthorization(request)
+	if record.exchangedToken != "" {
+		token = record.exchangedToken
+	}
+	request.Header.Set(jwtPlugin.forwardAuthHeader, token)
+	jwtPlugin.logf("debug", "forwarding the request with the token in %s", jwtPlugin.forwardAuthHeader)
+	jwtPlugin.next.ServeHTTP(rw, withUpstreamDecision(request, record.decision))
+	jwtPlugin.logLatency(start, record)
+}
+
+// withUpstreamDecision returns the request with the decision added to the decisions of earlier plugin instances.
+func withUpstreamDecision(request *http.Request, decision *UpstreamDecision) *http.Request {
+	if decision == nil {
+		return request
+	}
+	upstream, _ := request.Context().Value(upstreamDecisionsKey{}).([]UpstreamDecision)
+	decisions := append(append([]UpstreamDecision{}, upstream...), *decision)
+	return request.WithContext(context.WithValue(request.Context(), upstreamDecisionsKey{}, decisions))
+}
+
+// logLatency logs the duration of the request, broken down by stage when the token was checked.
+// The total includes the time spent upstream.
+func (jwtPlugin *JwtPlugin) logLatency(start time.Time, record *requestRecord) {
+	if !jwtPlugin.logEnabled("debug") {
+		return
+	}
+	if record == nil {
+		jwtPlugin.logf("debug", "ServeHTTP took %s", time.Since(start))
+		return
+	}
+	jwtPlugin.logf("debug", "ServeHTTP took %s (extraction %s, verification %s, opa %s, headers %s)",
+		time.Since(start), record.extractLatency, record.verifyLatency, record.opaLatency, record.headersLatency)
+}
+
+// bearerChallenge returns the RFC 6750 challenge of a request with a missing or invalid token, the error is only
+// included when a token was presented. The description of the error reveals internals like the key ids or the
+// failing checks, so it is only included with ExposeDenyReason.
+func (jwtPlugin *JwtPlugin) bearerChallenge(token string, err error) string {
+	var params []string
+	if jwtPlugin.realm != "" {
+		params = append(params, fmt.Sprintf("realm=%s", strconv.Quote(jwtPlugin.realm)))
+	}
+	if token != "" {
+		params = append(params, `error="invalid_token"`)
+		if jwtPlugin.exposeDenyReason {
+			params = append(params, fmt.Sprintf("error_description=%s", strconv.Quote(err.Error())))
+		}
+	}
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// ErrorDocument is the body of rejected requests when the ErrorFormat is json.
+type ErrorDocument struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Reason is the deny reason of the policy, only set when ExposeDenyReason is enabled
+	Reason  string `json:"reason,omitempty"`
+	TraceID string `json:"traceId,omitempty"`
+}
+
+// errorDocument renders the JSON error document, the ErrorMessage template has the variables of the DenyPage.
+func (jwtPlugin *JwtPlugin) errorDocument(request *http.Request, status int, reason string) ([]byte, error) {
+	data := denyPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+		RequestID:  request.Header.Get("X-Request-Id"),
+	}
+	var message bytes.Buffer
+	if err := jwtPlugin.errorMessage.Execute(&message, data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(ErrorDocument{Code: status, Message: message.String(), Reason: reason, TraceID: traceID(request)})
+}
+
+// traceID returns the X-Request-Id of the request, or the trace ID of its W3C traceparent header.
+func traceID(request *http.Request) string {
+	if requestID := request.Header.Get("X-Request-Id"); requestID != "" {
+		return requestID
+	}
+	if parts := strings.Split(request.Header.Get("traceparent"), "-"); len(parts) == 4 {
+		return parts[1]
+	}
+	return ""
+}
+
+// checkEmergencyToken tells whether the token is a valid emergency token for the request.
+// Every use of an emergency token is logged, including rejected uses.
+func (jwtPlugin *JwtPlugin) checkEmergencyToken(request *http.Request, token string) bool {
+	hash := sha256.Sum256([]byte(token))
+	for _, emergency := range jwtPlugin.emergencyTokens {
+		if subtle.ConstantTimeCompare(hash[:], emergency.hash) != 1 {
+			continue
+		}
+		if time.Now().After(emergency.expires) {
+			jwtPlugin.logEvent("warn", fmt.Sprintf("Rejected expired emergency token %s", emergency.name), request, nil)
+			return false
+		}
+		if len(emergency.paths) > 0 && !matchAnyPath(emergency.paths, request.URL.Path) {
+			jwtPlugin.logEvent("warn", fmt.Sprintf("Rejected emergency token %s for path %s", emergency.name, request.URL.Path), request, nil)
+			return false
+		}
+		jwtPlugin.logEvent("warn", fmt.Sprintf("EMERGENCY ACCESS: request allowed with emergency token %s", emergency.name), request, nil)
+		return true
+	}
+	return false
+}
+
+// matchMagicToken returns the magic token matching the bearer token, which must not be expired and must be used
+// from one of its source ranges. The tokens are compared by hash in constant time.
+func (jwtPlugin *JwtPlugin) matchMagicToken(request *http.Request, token string) *magicToken {
+	if token == "" {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(token))
+	for i := range jwtPlugin.magicTokens {
+		magic := &jwtPlugin.magicTokens[i]
+		if subtle.ConstantTimeCompare(hash[:], magic.hash) != 1 {
+			continue
+		}
+		if !magic.expires.IsZero() && time.Now().After(magic.expires) {
+			jwtPlugin.logEvent("warn", fmt.Sprintf("Rejected expired magic token %d", i), request, nil)
+			return nil
+		}
+		if len(magic.sourceRanges) > 0 && !inRanges(magic.sourceRanges, request.RemoteAddr) {
+			jwtPlugin.logEvent("warn", fmt.Sprintf("Rejected magic token %d from %s", i, request.RemoteAddr), request, nil)
+			return nil
+		}
+		return magic
+	}
+	return nil
+}
+
+// connectionIP returns the host of the address of the connection, without the port.
+func connectionIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// inRanges tells whether the host of the address is in one of the networks. The address of the connection is used
+// rather than the X-Forwarded-For header, which clients can set.
+func inRanges(networks []*net.IPNet, remoteAddr string) bool {
+	ip := net.ParseIP(connectionIP(remoteAddr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckToken verifies the token of the request and checks the request with OPA.
+func (jwtPlugin *JwtPlugin) CheckToken(request *http.Request) error {
+	return jwtPlugin.checkToken(request, make(http.Header), jwtPlugin.newRequestRecord(request))
+}
+
+// checkToken verifies the token of the request and checks the request with OPA.
+// Headers for the client response are added to responseHeader, the outcome of the checks to the record.
+func (jwtPlugin *JwtPlugin) checkToken(request *http.Request, responseHeader http.Header, record *requestRecord) error {
+	if jwtPlugin.tenants {
+		return fmt.Errorf("unknown tenant %s", request.Host)
+	}
+	stages := jwtPlugin.stageRule(request)
+	var jwtToken *JWT
+	var err error
+	introspected := false
+	if !stages.SkipJwt {
+		extractSpan := jwtPlugin.startSpan(request, "ExtractToken")
+		extractStart := time.Now()
+		if auth := jwtPlugin.authorization(request); jwtPlugin.introspector != nil && strings.HasPrefix(auth, "Bearer ") && opaqueToken(auth[7:]) {
+			// opaque tokens are verified by the introspection endpoint
+			jwtToken, err = jwtPlugin.introspector.introspect(auth[7:])
+			introspected = jwtToken != nil
+		} else {
+			jwtToken, err = jwtPlugin.ExtractToken(request)
+		}
+		record.extractLatency = time.Since(extractStart)
+		extractSpan.end()
+		if err != nil {
+			return err
+		}
+	}
+	// assertions of load balancers are verified on extraction
+	assertionToken := false
+	if len(jwtPlugin.assertions) > 0 && !stages.SkipJwt {
+		if jwtPlugin.assertionsExclusive {
+			jwtToken = nil
+		}
+		for _, source := range jwtPlugin.assertions {
+			if jwtToken != nil {
+				break
+			}
+			if jwtToken, err = source.extract(request); err != nil {
+				return err
+			}
+			assertionToken = jwtToken != nil
+		}
+	}
+	verify := true
+	if jwtToken == nil && jwtPlugin.trustedIdentityHeader != "" && !stages.SkipJwt {
+		jwtToken, verify, err = jwtPlugin.trustedIdentity(request, record.trustedIdentity)
+		if err != nil {
+			return err
+		}
+	}
+	if jwtToken == nil && jwtPlugin.anonymousIdentity {
+		jwtToken = jwtPlugin.AnonymousToken()
+	}
+	if jwtToken == nil && jwtPlugin.required && !jwtPlugin.allowAnonymous && !stages.SkipJwt {
+		return errors.New("missing bearer token")
+	}
+	if jwtToken != nil {
+		// only verify jwt tokens if keys are configured
+		if verify && !assertionToken && !introspected && !jwtToken.Anonymous && (jwtPlugin.keyCount() > 0 || len(jwtPlugin.jwkEndpoints) > 0) {
+			verifySpan := jwtPlugin.startSpan(request, "VerifyToken")
+			verifyStart := time.Now()
+			generation := jwtPlugin.keyGeneration()
+			if kid, ok := jwtPlugin.verificationCache.get(jwtToken, generation); ok {
+				jwtToken.KeyID = kid
+			} else if err = jwtPlugin.VerifyToken(jwtToken); err == nil {
+				jwtPlugin.verificationCache.add(jwtToken, generation)
+			}
+			record.verifyLatency = time.Since(verifyStart)
+			verifySpan.end()
+			if err != nil {
+				return err
+			}
+			if retired, ok := jwtPlugin.retiredKeys[jwtToken.KeyID]; ok {
+				if time.Now().After(retired) {
+					return fmt.Errorf("token signed with retired key %s", jwtToken.KeyID)
+				}
+				jwtPlugin.logEvent("warn", fmt.Sprintf("Token signed with key %s which is retired at %s", jwtToken.KeyID, retired.Format(time.RFC3339)), request, jwtToken)
+			}
+		}
+		if jwtToken.Nested != "" {
+			if jwtToken, err = jwtPlugin.unwrapToken(jwtToken, verify && !assertionToken && !introspected); err != nil {
+				return err
+			}
+		}
+		// the claims of a token are only recorded once its signature is verified, they are forged otherwise
+		record.token = jwtToken
+		if jwtPlugin.requireTokenType != "" && verify && !assertionToken && !introspected && !jwtToken.Anonymous {
+			if err = jwtPlugin.checkTokenType(jwtToken); err != nil {
+				return err
+			}
+		}
+		if jwtPlugin.revocations != nil && !jwtToken.Anonymous {
+			if err = jwtPlugin.revocations.check(jwtToken); err != nil {
+				return err
+			}
+		}
+		if jwtPlugin.validateExpiry && verify && !jwtToken.Anonymous {
+			if err = jwtPlugin.checkExpiry(jwtToken); err != nil {
+				return err
+			}
+		}
+		if jwtPlugin.maxTokenLifetime > 0 && verify && !jwtToken.Anonymous {
+			if err = jwtPlugin.checkLifetime(jwtToken); err != nil {
+				return err
+			}
+		}
+		if jwtPlugin.iss != "" && !jwtToken.Anonymous {
+			if iss, _ := jwtToken.Payload["iss"].(string); iss != jwtPlugin.iss {
+				return fmt.Errorf("token issuer %s not accepted", iss)
+			}
+		}
+		if len(jwtPlugin.audiences) > 0 && !jwtToken.Anonymous {
+			if err = jwtPlugin.checkAudience(jwtToken); err != nil {
+				return err
+			}
+		}
+		if err = checkCertificateBinding(request, jwtToken); err != nil {
+			return err
+		}
+		// the synthesized anonymous identity is not expected to carry the payload fields
+		for _, fieldName := range jwtPlugin.payloadFields {
+			if _, ok := jwtToken.Payload[fieldName]; !ok && !jwtToken.Anonymous {
+				if jwtPlugin.required {
+					return fmt.Errorf("payload missing required field %s", fieldName)
+				} else {
+					jwtPlugin.logEvent("warn", fmt.Sprintf("Missing JWT field %s", fieldName), request, jwtToken)
 				}
-			default:
-				jwtPlugin.log("unrecognized key %s in jwks", key.Kty)
 			}
 		}
+		if !jwtToken.Anonymous {
+			if err = jwtPlugin.checkSubject(jwtToken); err != nil {
+				return err
+			}
+		}
+		if err = checkClaims(jwtToken, jwtPlugin.requireClaims); err != nil {
+			return err
+		}
+		if err = checkScopes(jwtToken, jwtPlugin.requiredScopes); err != nil {
+			return err
+		}
+		if err = checkRoles(jwtToken, jwtPlugin.requiredRoles); err != nil {
+			return err
+		}
+		if err = jwtPlugin.checkNetworks(request, jwtToken); err != nil {
+			return err
+		}
+		headersStart := time.Now()
+		jwtPlugin.transformer.apply(request, responseHeader, jwtToken.Payload)
+		jwtPlugin.tagRequest(request, jwtToken)
+		if jwtPlugin.userinfoHeader != "" {
+			jwtPlugin.setUserinfo(request, jwtToken)
+		}
+		if jwtPlugin.forwardPayloadHeader != "" {
+			jwtPlugin.forwardPayload(request, jwtToken, verify)
+		}
+		if jwtPlugin.rolesHeader != "" {
+			request.Header.Set(jwtPlugin.rolesHeader, strings.Join(keycloakRoles(jwtToken.Payload), ","))
+		}
+		record.headersLatency = time.Since(headersStart)
+	}
+	if jwtPlugin.authStatusHeader != "" {
+		status := "anonymous"
+		if jwtToken != nil && !jwtToken.Anonymous {
+			status = "authenticated"
+		}
+		request.Header.Set(jwtPlugin.authStatusHeader, status)
+	}
+	if err = jwtPlugin.checkAccessRules(request, jwtToken); err != nil {
+		return err
+	}
+	if err = jwtPlugin.checkExpressions(request, jwtToken); err != nil {
+		return err
+	}
+	// throttled before OPA, so noisy subjects don't load the policy engine
+	if err = jwtPlugin.checkRateLimit(jwtToken); err != nil {
+		return err
+	}
+	if jwtPlugin.opaUrl != "" && !stages.SkipOpa {
+		opaStart := time.Now()
+		decision, err := jwtPlugin.checkOpa(request, jwtToken, responseHeader)
+		record.decision = decision
+		record.opaLatency = time.Since(opaStart)
+		if err != nil {
+			if !errors.Is(err, errOpaUnavailable) || !jwtPlugin.opaFailOpen(request) {
+				return err
+			}
+			jwtPlugin.logEvent("warn", fmt.Sprintf("Allowing request while OPA is unavailable: %s", err.Error()), request, jwtToken)
+			if jwtPlugin.envoyExtAuthz {
+				request.Header.Set(envoyFailureModeAllowedHeader, "true")
+			}
+		}
+	}
+	// the jti is only recorded for accepted requests, so a denied request doesn't consume the token
+	if jwtPlugin.preventReplay && jwtToken != nil && !jwtToken.Anonymous {
+		if err = jwtPlugin.checkReplay(jwtToken); err != nil {
+			return err
+		}
+	}
+	// only bearer tokens are exchanged, the identities asserted by proxies have no token to exchange
+	if auth := jwtPlugin.authorization(request); jwtPlugin.tokenExchanger != nil && jwtToken != nil && !jwtToken.Anonymous && strings.HasPrefix(auth, "Bearer ") {
+		if record.exchangedToken, err = jwtPlugin.tokenExchanger.exchange(auth[7:], jwtToken); err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+record.exchangedToken)
 	}
-	jwtPlugin.log("fetching keys finished. Key set is now:", jwtPlugin.keys)
+	return nil
 }
 
-func (jwtPlugin *JwtPlugin) ServeHTTP(rw http.ResponseWriter, request *http.Request) {
-	start := time.Now()
-	jwtPlugin.log("ServeHTTP received request")
-	token := request.Header.Get("Authorization")
-	token = strings.TrimSpace(token)
-	token = strings.Replace(token, "Bearer ", "", 1)
-	// if magic token mode is enable, which is for testing tools to bypass auth with a fake user
-	// then skip the auth check stage and forward on a mocked token
-	if jwtPlugin.enableMagicToken {
-		// check if magic token set
-		if token == jwtPlugin.magicToken {
-			jwtPlugin.log("bearer token matched magic token. %s=%s", jwtPlugin.forwardAuthHeader, jwtPlugin.magicTokenForwardAuth)
-			// remove Authorization header from original request
-			request.Header.Del(jwtPlugin.forwardAuthErrorHeader)
-			request.Header.Set(jwtPlugin.forwardAuthHeader, jwtPlugin.magicTokenForwardAuth)
-			jwtPlugin.next.ServeHTTP(rw, request)
-			jwtPlugin.log("ServeHTTP took %s", time.Since(start).String())
-			return
+// skipPath tells whether the path matches one of the SkipPaths, either a glob pattern or a regular expression.
+func (jwtPlugin *JwtPlugin) skipPath(requestPath string) bool {
+	if matchAnyPath(jwtPlugin.skipPaths, requestPath) {
+		return true
+	}
+	for _, regex := range jwtPlugin.skipPathRegexes {
+		if regex.MatchString(requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// stageRule returns the first StageRule matching the request, or an empty rule which skips nothing.
+func (jwtPlugin *JwtPlugin) stageRule(request *http.Request) StageRule {
+	for _, rule := range jwtPlugin.stageRules {
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, request.Method) {
+			continue
+		}
+		if matchAnyPath(rule.Paths, request.URL.Path) {
+			return rule
+		}
+	}
+	return StageRule{}
+}
+
+// checkNetworks rejects the tokens whose claims restrict them to other networks than the address of the connection,
+// like the SourceRanges of the magic tokens.
+func (jwtPlugin *JwtPlugin) checkNetworks(request *http.Request, jwtToken *JWT) error {
+	for i, rule := range jwtPlugin.networkRules {
+		value, ok := valueAtPath(jwtToken.Payload, rule.claim)
+		if !ok || !claimMatches(value, rule.anyOf) {
+			continue
+		}
+		if !inRanges(rule.sourceRanges, request.RemoteAddr) {
+			return &forbiddenError{
+				msg:    fmt.Sprintf("token with claim %s not accepted from %s by network rule %d", rule.claim, request.RemoteAddr, i),
+				reason: fmt.Sprintf("claim %s not accepted from this network", rule.claim),
+			}
+		}
+	}
+	return nil
+}
+
+// checkAccessRules enforces the first AccessRule matching the request.
+func (jwtPlugin *JwtPlugin) checkAccessRules(request *http.Request, jwtToken *JWT) error {
+	for _, rule := range jwtPlugin.accessRules {
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, request.Method) {
+			continue
+		}
+		if !matchAnyPath(rule.Paths, request.URL.Path) {
+			continue
+		}
+		if jwtToken == nil {
+			return errors.New("missing bearer token")
+		}
+		if err := checkClaims(jwtToken, rule.RequireClaims); err != nil {
+			return err
+		}
+		if err := checkScopes(jwtToken, rule.RequiredScopes); err != nil {
+			return err
+		}
+		return checkRoles(jwtToken, rule.RequiredRoles)
+	}
+	return nil
+}
+
+// isErrorStatus tells whether the status is a client or server error, including non-standard ones like 498.
+func isErrorStatus(status int) bool {
+	return status >= 400 && status <= 599
+}
+
+// containsFold tells whether the values contain the value, ignoring case.
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRequestRecord takes the TrustedIdentityHeader out of the request, the asserted identity is only meant for the
+// plugin and must not reach upstreams, also when it isn't used.
+func (jwtPlugin *JwtPlugin) newRequestRecord(request *http.Request) *requestRecord {
+	record := &requestRecord{}
+	if jwtPlugin.trustedIdentityHeader != "" {
+		record.trustedIdentity = request.Header.Get(jwtPlugin.trustedIdentityHeader)
+		request.Header.Del(jwtPlugin.trustedIdentityHeader)
+	}
+	return record
+}
+
+// inboundIdentityHeaders lists the request headers set by the plugin, except the headers carrying the credentials.
+func (jwtPlugin *JwtPlugin) inboundIdentityHeaders() []string {
+	headers := jwtPlugin.transformer.requestHeaders()
+	for header := range jwtPlugin.opaHeaders {
+		headers = append(headers, header)
+	}
+	for _, tag := range jwtPlugin.requestTags {
+		headers = append(headers, tag.Header)
+	}
+	headers = append(headers, jwtPlugin.forwardAuthHeader, jwtPlugin.userinfoHeader, jwtPlugin.rolesHeader, jwtPlugin.forwardPayloadHeader,
+		jwtPlugin.authStatusHeader)
+	var identityHeaders []string
+	for _, header := range headers {
+		canonical := http.CanonicalHeaderKey(header)
+		if header == "" || canonical == "Authorization" || canonical == "Proxy-Authorization" ||
+			canonical == http.CanonicalHeaderKey(jwtPlugin.trustedIdentityHeader) {
+			continue
+		}
+		identityHeaders = append(identityHeaders, header)
+	}
+	return identityHeaders
+}
+
+// authorization returns the Authorization header of the request. When ProxyAuthorization is enabled
+// and the request has no Authorization header, the Proxy-Authorization header is returned instead.
+func (jwtPlugin *JwtPlugin) authorization(request *http.Request) string {
+	if auth, ok := request.Header["Authorization"]; ok {
+		return auth[0]
+	}
+	if jwtPlugin.proxyAuthorization {
+		return request.Header.Get("Proxy-Authorization")
+	}
+	return ""
+}
+
+// stripProxyAuthorization removes the Proxy-Authorization header, its credentials are meant for this proxy only.
+func (jwtPlugin *JwtPlugin) stripProxyAuthorization(request *http.Request) {
+	if jwtPlugin.proxyAuthorization {
+		request.Header.Del("Proxy-Authorization")
+	}
+}
+
+func (jwtPlugin *JwtPlugin) ExtractToken(request *http.Request) (*JWT, error) {
+	auth := jwtPlugin.authorization(request)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	return parseToken(auth[7:])
+}
+
+// ExtractTrustedIdentity converts the identity asserted by an upstream proxy in the
+// TrustedIdentityHeader into a token. The returned flag tells whether the token
+// carries a signature which needs to be verified.
+func (jwtPlugin *JwtPlugin) ExtractTrustedIdentity(request *http.Request) (*JWT, bool, error) {
+	return jwtPlugin.trustedIdentity(request, request.Header.Get(jwtPlugin.trustedIdentityHeader))
+}
+
+// trustedIdentity converts the value of the TrustedIdentityHeader, which is only accepted from the
+// TrustedIdentitySourceRanges when configured.
+func (jwtPlugin *JwtPlugin) trustedIdentity(request *http.Request, value string) (*JWT, bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, false, nil
+	}
+	if len(jwtPlugin.trustedIdentitySourceRanges) > 0 && !inRanges(jwtPlugin.trustedIdentitySourceRanges, request.RemoteAddr) {
+		return nil, false, fmt.Errorf("identity header %s not accepted from %s", jwtPlugin.trustedIdentityHeader, request.RemoteAddr)
+	}
+	switch jwtPlugin.trustedIdentityFormat {
+	case "jwt":
+		jwtToken, err := parseToken(strings.TrimPrefix(value, "Bearer "))
+		return jwtToken, true, err
+	case "json":
+		claims := []byte(value)
+		if !strings.HasPrefix(value, "{") {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				if decoded, err = base64.StdEncoding.DecodeString(value); err != nil {
+					return nil, false, fmt.Errorf("invalid identity header %s: %v", jwtPlugin.trustedIdentityHeader, err)
+				}
+			}
+			claims = decoded
+		}
+		jwtToken := JWT{}
+		if err := json.Unmarshal(claims, &jwtToken.Payload); err != nil {
+			return nil, false, fmt.Errorf("invalid identity header %s: %v", jwtPlugin.trustedIdentityHeader, err)
+		}
+		return &jwtToken, false, nil
+	default:
+		return &JWT{Payload: map[string]interface{}{"sub": value}}, false, nil
+	}
+}
+
+// checkAudience verifies that one of the audiences of the token matches one of the configured audiences.
+func (jwtPlugin *JwtPlugin) checkAudience(jwtToken *JWT) error {
+	var audiences []string
+	switch aud := jwtToken.Payload["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	for _, aud := range audiences {
+		for _, pattern := range jwtPlugin.audiences {
+			if matchWildcard(pattern, aud) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("token audience %v not accepted", audiences)
+}
+
+// maxNestedTokens bounds the nesting of the tokens, so a crafted token can't cost an unbounded number of verifications.
+const maxNestedTokens = 3
+
+// unwrapToken returns the innermost token of a nested JWT, whose claims apply to the request. Each inner token is
+// verified like the outer token. Encrypted inner tokens (JWE) are not supported.
+func (jwtPlugin *JwtPlugin) unwrapToken(jwtToken *JWT, verify bool) (*JWT, error) {
+	for depth := 0; jwtToken.Nested != ""; depth++ {
+		if depth == maxNestedTokens {
+			return nil, fmt.Errorf("token is nested more than %d times", maxNestedTokens)
+		}
+		if strings.Count(jwtToken.Nested, ".") == 4 {
+			return nil, errors.New("encrypted nested tokens are not supported")
+		}
+		inner, err := parseToken(jwtToken.Nested)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nested token: %v", err)
+		}
+		if verify && (jwtPlugin.keyCount() > 0 || len(jwtPlugin.jwkEndpoints) > 0) {
+			generation := jwtPlugin.keyGeneration()
+			if kid, ok := jwtPlugin.verificationCache.get(inner, generation); ok {
+				inner.KeyID = kid
+			} else if err = jwtPlugin.VerifyToken(inner); err != nil {
+				return nil, fmt.Errorf("invalid nested token: %v", err)
+			} else {
+				jwtPlugin.verificationCache.add(inner, generation)
+			}
+		}
+		inner.Raw = jwtToken.Raw
+		jwtToken = inner
+	}
+	return jwtToken, nil
+}
+
+// checkTokenType verifies the typ header of the token, e.g. at+jwt for access tokens (RFC 9068), so other tokens
+// of the issuer like ID tokens can't be used as access tokens. The application/ prefix of media types is optional.
+func (jwtPlugin *JwtPlugin) checkTokenType(jwtToken *JWT) error {
+	typ := strings.TrimPrefix(strings.ToLower(jwtToken.Header.Typ), "application/")
+	if typ != strings.TrimPrefix(strings.ToLower(jwtPlugin.requireTokenType), "application/") {
+		return fmt.Errorf("token type %s not accepted, expecting %s", jwtToken.Header.Typ, jwtPlugin.requireTokenType)
+	}
+	return nil
+}
+
+// checkCertificateBinding verifies that a token bound to a client certificate (RFC 8705) is presented with
+// that certificate, so a stolen token can't be replayed by other clients.
+func checkCertificateBinding(request *http.Request, jwtToken *JWT) error {
+	cnf, _ := jwtToken.Payload["cnf"].(map[string]interface{})
+	thumbprint, ok := cnf["x5t#S256"].(string)
+	if !ok {
+		return nil
+	}
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return errors.New("token is bound to a client certificate, but none was presented")
+	}
+	digest := sha256.Sum256(request.TLS.PeerCertificates[0].Raw)
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(digest[:])), []byte(strings.TrimRight(thumbprint, "="))) != 1 {
+		return errors.New("token is bound to another client certificate")
+	}
+	return nil
+}
+
+// checkSubject rejects the subjects matching the DeniedSubjects and, when AllowedSubjects are configured, the
+// subjects which don't match any of them. Both accept `*` wildcards, e.g. to block a compromised service account.
+func (jwtPlugin *JwtPlugin) checkSubject(jwtToken *JWT) error {
+	sub, _ := jwtToken.Payload["sub"].(string)
+	for _, pattern := range jwtPlugin.deniedSubjects {
+		if matchWildcard(pattern, sub) {
+			reason := fmt.Sprintf("subject %s denied", sub)
+			return &forbiddenError{msg: reason, reason: reason}
+		}
+	}
+	if len(jwtPlugin.allowedSubjects) == 0 {
+		return nil
+	}
+	for _, pattern := range jwtPlugin.allowedSubjects {
+		if matchWildcard(pattern, sub) {
+			return nil
+		}
+	}
+	reason := fmt.Sprintf("subject %s not allowed", sub)
+	return &forbiddenError{msg: reason, reason: reason}
+}
+
+// checkClaims enforces the RequireClaims rules, a missing claim doesn't match.
+func checkClaims(jwtToken *JWT, rules []ClaimRule) error {
+	for _, rule := range rules {
+		values := rule.AnyOf
+		if rule.Equals != "" {
+			values = []string{rule.Equals}
+		}
+		value, ok := valueAtPath(jwtToken.Payload, rule.Claim)
+		if !ok || !claimMatches(value, values) {
+			reason := fmt.Sprintf("claim %s not accepted", rule.Claim)
+			return &forbiddenError{msg: reason, reason: reason}
+		}
+	}
+	return nil
+}
+
+// checkScopes requires the scopes in the space-delimited scope claim or the scp claim (an array, or
+// space-delimited like scope). Missing scopes are rejected with the insufficient_scope error of RFC 6750.
+func checkScopes(jwtToken *JWT, requiredScopes []string) error {
+	if len(requiredScopes) == 0 {
+		return nil
+	}
+	granted := make(map[string]bool)
+	for _, name := range []string{"scope", "scp"} {
+		switch scopes := jwtToken.Payload[name].(type) {
+		case string:
+			for _, scope := range strings.Fields(scopes) {
+				granted[scope] = true
+			}
+		case []interface{}:
+			for _, scope := range scopes {
+				if s, ok := scope.(string); ok {
+					granted[s] = true
+				}
+			}
+		}
+	}
+	for _, scope := range requiredScopes {
+		if !granted[scope] {
+			scopes := strings.Join(requiredScopes, " ")
+			reason := fmt.Sprintf("missing scope %s", scope)
+			header := make(http.Header)
+			header.Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scopes))
+			return &forbiddenError{msg: reason, reason: reason, header: header}
+		}
+	}
+	return nil
+}
+
+// checkRoles requires the roles in the Keycloak role claims, see keycloakRoles.
+func checkRoles(jwtToken *JWT, requiredRoles []string) error {
+	if len(requiredRoles) == 0 {
+		return nil
+	}
+	granted := make(map[string]bool)
+	for _, role := range keycloakRoles(jwtToken.Payload) {
+		granted[role] = true
+	}
+	for _, role := range requiredRoles {
+		if !granted[role] {
+			reason := fmt.Sprintf("missing role %s", role)
+			return &forbiddenError{msg: reason, reason: reason}
+		}
+	}
+	return nil
+}
+
+// keycloakRoles flattens the realm roles (realm_access.roles) and the client roles (resource_access.<client>.roles)
+// of a Keycloak token, client roles are prefixed with the client, e.g. account:manage-account.
+func keycloakRoles(payload map[string]interface{}) []string {
+	var roles []string
+	if realm, ok := valueAtPath(payload, "realm_access.roles"); ok {
+		roles = appendStrings(roles, "", realm)
+	}
+	if resources, ok := payload["resource_access"].(map[string]interface{}); ok {
+		clients := make([]string, 0, len(resources))
+		for client := range resources {
+			clients = append(clients, client)
+		}
+		sort.Strings(clients)
+		for _, client := range clients {
+			if clientRoles, ok := valueAtPath(resources[client], "roles"); ok {
+				roles = appendStrings(roles, client+":", clientRoles)
+			}
+		}
+	}
+	return roles
+}
+
+// appendStrings appends the string elements of an array claim with the prefix.
+func appendStrings(values []string, prefix string, claim interface{}) []string {
+	elements, _ := claim.([]interface{})
+	for _, element := range elements {
+		if s, ok := element.(string); ok {
+			values = append(values, prefix+s)
+		}
+	}
+	return values
+}
+
+// checkExpiry validates the exp and nbf claims. Only the tokens of ServiceTokenSubjects may lack an exp claim.
+func (jwtPlugin *JwtPlugin) checkExpiry(jwtToken *JWT) error {
+	now := time.Now()
+	if exp, ok := jwtToken.Payload["exp"]; ok {
+		expires, ok := exp.(float64)
+		if !ok {
+			return fmt.Errorf("invalid exp claim %v", exp)
+		}
+		if now.After(time.Unix(int64(expires), 0).Add(jwtPlugin.clockSkew)) {
+			return fmt.Errorf("token expired")
+		}
+	} else if !jwtPlugin.serviceToken(jwtToken) {
+		return fmt.Errorf("token has no exp claim")
+	}
+	if nbf, ok := jwtToken.Payload["nbf"]; ok {
+		notBefore, ok := nbf.(float64)
+		if !ok {
+			return fmt.Errorf("invalid nbf claim %v", nbf)
+		}
+		if now.Add(jwtPlugin.clockSkew).Before(time.Unix(int64(notBefore), 0)) {
+			return fmt.Errorf("token not valid yet")
+		}
+	}
+	return nil
+}
+
+// checkLifetime rejects the tokens which are valid longer than the MaxTokenLifetime, measured from the iat claim
+// and from now, so misissued long-lived tokens are rejected even without an iat. Only the tokens of the
+// ServiceTokenSubjects may have no exp.
+func (jwtPlugin *JwtPlugin) checkLifetime(jwtToken *JWT) error {
+	exp, ok := jwtToken.Payload["exp"].(float64)
+	if !ok {
+		if jwtPlugin.serviceToken(jwtToken) {
+			return nil
+		}
+		return fmt.Errorf("token has no exp claim, its lifetime exceeds %s", jwtPlugin.maxTokenLifetime)
+	}
+	expires := time.Unix(int64(exp), 0)
+	if iat, ok := jwtToken.Payload["iat"].(float64); ok && expires.Sub(time.Unix(int64(iat), 0)) > jwtPlugin.maxTokenLifetime {
+		return fmt.Errorf("token lifetime %s exceeds %s", expires.Sub(time.Unix(int64(iat), 0)), jwtPlugin.maxTokenLifetime)
+	}
+	if time.Until(expires) > jwtPlugin.maxTokenLifetime+jwtPlugin.clockSkew {
+		return fmt.Errorf("token expires in %s, beyond the maximum lifetime %s", time.Until(expires).Round(time.Second), jwtPlugin.maxTokenLifetime)
+	}
+	return nil
+}
+
+// serviceToken tells whether the sub or client_id of the token is one of the ServiceTokenSubjects.
+func (jwtPlugin *JwtPlugin) serviceToken(jwtToken *JWT) bool {
+	for _, subject := range jwtPlugin.serviceTokenSubjects {
+		if jwtToken.Payload["sub"] == subject || jwtToken.Payload["client_id"] == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard matches the value against a pattern in which `*` matches any sequence of characters.
+func matchWildcard(pattern string, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// tagRequest sets the headers of the RequestTags. For each header the first matching
+// tag wins, inbound values are always replaced.
+func (jwtPlugin *JwtPlugin) tagRequest(request *http.Request, jwtToken *JWT) {
+	for _, tag := range jwtPlugin.requestTags {
+		request.Header.Del(tag.Header)
+	}
+	for _, tag := range jwtPlugin.requestTags {
+		if request.Header.Get(tag.Header) != "" {
+			continue
+		}
+		if tag.Claim != "" {
+			value, ok := jwtToken.Payload[tag.Claim]
+			if !ok || (len(tag.Values) > 0 && !claimMatches(value, tag.Values)) {
+				continue
+			}
+		}
+		request.Header.Set(tag.Header, tag.Value)
+	}
+}
+
+// setUserinfo sets the UserinfoHeader to the base64 encoded JSON of the UserinfoClaims (all claims when empty),
+// like the X-Userinfo header of Kong's OIDC plugin. Inbound values are always replaced.
+func (jwtPlugin *JwtPlugin) setUserinfo(request *http.Request, jwtToken *JWT) {
+	request.Header.Del(jwtPlugin.userinfoHeader)
+	claims := jwtToken.Payload
+	if len(jwtPlugin.userinfoClaims) > 0 {
+		claims = make(map[string]interface{})
+		for _, name := range jwtPlugin.userinfoClaims {
+			if value, ok := jwtToken.Payload[name]; ok {
+				claims[name] = value
+			}
 		}
 	}
-
-	if err := jwtPlugin.CheckToken(request); err != nil {
-		errMsg := fmt.Sprintf("token validation failed: %s", err.Error())
-		jwtPlugin.log("ERR", errMsg)
-		jwtPlugin.ForwardError(rw, errMsg, http.StatusUnauthorized, request)
-		jwtPlugin.log("ServeHTTP took %s", time.Since(start).String())
+	userinfo, err := json.Marshal(claims)
+	if err != nil {
+		jwtPlugin.logf("error", "marshalling userinfo: %v", err)
 		return
 	}
-	request.Header.Del(jwtPlugin.forwardAuthErrorHeader)
-	request.Header.Set(jwtPlugin.forwardAuthHeader, token)
-	jwtPlugin.log("bearer token matched magic token. %s=%s", jwtPlugin.forwardAuthHeader, jwtPlugin.magicTokenForwardAuth)
-	jwtPlugin.next.ServeHTTP(rw, request)
-	jwtPlugin.log("ServeHTTP took %s", time.Since(start).String())
+	request.Header.Set(jwtPlugin.userinfoHeader, base64.StdEncoding.EncodeToString(userinfo))
 }
 
-func (jwtPlugin *JwtPlugin) CheckToken(request *http.Request) error {
-	jwtToken, err := jwtPlugin.ExtractToken(request)
+// forwardPayload sets the ForwardPayloadHeader to the base64 encoded JSON of all claims, like the x-amzn-oidc-data
+// header of AWS ALB. Only verified tokens are forwarded, inbound values are always removed.
+func (jwtPlugin *JwtPlugin) forwardPayload(request *http.Request, jwtToken *JWT, verified bool) {
+	request.Header.Del(jwtPlugin.forwardPayloadHeader)
+	if !verified || jwtToken.Anonymous {
+		return
+	}
+	payload, err := json.Marshal(jwtToken.Payload)
 	if err != nil {
-		return err
+		jwtPlugin.logf("error", "marshalling payload: %v", err)
+		return
 	}
-	if jwtToken != nil {
-		// only verify jwt tokens if keys are configured
-		if len(jwtPlugin.keys) > 0 || len(jwtPlugin.jwkEndpoints) > 0 {
-			if err = jwtPlugin.VerifyToken(jwtToken); err != nil {
-				return err
-			}
-		}
-		for _, fieldName := range jwtPlugin.payloadFields {
-			if _, ok := jwtToken.Payload[fieldName]; !ok {
-				if jwtPlugin.required {
-					return fmt.Errorf("payload missing required field %s", fieldName)
-				} else {
-					sub := fmt.Sprint(jwtToken.Payload["sub"])
-					network := jwtPlugin.remoteAddr(request)
-					jsonLogEvent, _ := json.Marshal(&LogEvent{
-						Level:   "warning",
-						Msg:     fmt.Sprintf("Missing JWT field %s", fieldName),
-						Time:    time.Now(),
-						Sub:     sub,
-						Network: network,
-						URL:     request.URL.String(),
-					})
-					fmt.Println(string(jsonLogEvent))
-				}
-			}
-		}
-		for k, v := range jwtPlugin.jwtHeaders {
-			value, ok := jwtToken.Payload[v]
-			if ok {
-				request.Header.Add(k, value.(string))
+	request.Header.Set(jwtPlugin.forwardPayloadHeader, base64.StdEncoding.EncodeToString(payload))
+}
+
+// claimMatches tells whether the claim (or any element of an array claim) equals one of the values.
+func claimMatches(claim interface{}, values []string) bool {
+	if elements, ok := claim.([]interface{}); ok {
+		for _, element := range elements {
+			if claimMatches(element, values) {
+				return true
 			}
 		}
+		return false
 	}
-	if jwtPlugin.opaUrl != "" {
-		if err := jwtPlugin.CheckOpa(request, jwtToken); err != nil {
-			return err
+	s := fmt.Sprint(claim)
+	for _, value := range values {
+		if s == value {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func (jwtPlugin *JwtPlugin) ExtractToken(request *http.Request) (*JWT, error) {
-	authHeader, ok := request.Header["Authorization"]
-	if !ok {
-		return nil, nil
-	}
-	auth := authHeader[0]
-	if !strings.HasPrefix(auth, "Bearer ") {
-		return nil, nil
+// AnonymousToken synthesizes the identity used for requests without a token, so
+// policies and upstreams handle a single identity model.
+func (jwtPlugin *JwtPlugin) AnonymousToken() *JWT {
+	payload := map[string]interface{}{"sub": "anonymous"}
+	for k, v := range jwtPlugin.anonymousClaims {
+		payload[k] = v
 	}
-	parts := strings.Split(auth[7:], ".")
+	return &JWT{Payload: payload, Anonymous: true}
+}
+
+func parseToken(token string) (*JWT, error) {
+	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("invalid token format")
 	}
@@ -438,13 +2840,18 @@ func (jwtPlugin *JwtPlugin) ExtractToken(request *http.Request) (*JWT, error) {
 		return nil, err
 	}
 	jwtToken := JWT{
-		Plaintext: []byte(auth[7 : len(parts[0])+len(parts[1])+8]),
+		Plaintext: []byte(token[:len(parts[0])+len(parts[1])+1]),
 		Signature: signature,
+		Raw:       token,
 	}
 	err = json.Unmarshal(header, &jwtToken.Header)
 	if err != nil {
 		return nil, err
 	}
+	if strings.EqualFold(jwtToken.Header.Cty, "JWT") {
+		jwtToken.Nested = string(payload)
+		return &jwtToken, nil
+	}
 	err = json.Unmarshal(payload, &jwtToken.Payload)
 	if err != nil {
 		return nil, err
@@ -491,6 +2898,7 @@ func (jwtPlugin *JwtPlugin) remoteAddr(req *http.Request) Network {
 }
 
 func (jwtPlugin *JwtPlugin) VerifyToken(jwtToken *JWT) error {
+	jwtPlugin.faults.delayVerify()
 	for _, h := range jwtToken.Header.Crit {
 		if _, ok := supportedHeaderNames[h]; !ok {
 			return fmt.Errorf("unsupported header: %s", h)
@@ -504,13 +2912,29 @@ func (jwtPlugin *JwtPlugin) VerifyToken(jwtToken *JWT) error {
 	if jwtPlugin.alg != "" && jwtToken.Header.Alg != jwtPlugin.alg {
 		return fmt.Errorf("incorrect alg, expected %s got %s", jwtPlugin.alg, jwtToken.Header.Alg)
 	}
+	if jwtPlugin.requireKid && jwtToken.Header.Kid == "" {
+		return fmt.Errorf("token has no kid")
+	}
+	jwtPlugin.keysLock.RLock()
+	defer jwtPlugin.keysLock.RUnlock()
 	key, ok := jwtPlugin.keys[jwtToken.Header.Kid]
 	if ok {
+		if !keyFitsAlg(key, jwtToken.Header.Alg) {
+			return fmt.Errorf("key %s doesn't fit alg %s", jwtToken.Header.Kid, jwtToken.Header.Alg)
+		}
+		jwtToken.KeyID = jwtToken.Header.Kid
 		return a.verify(key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
+	} else if jwtPlugin.requireKid {
+		// the kid must select the key, without trying every key
+		return fmt.Errorf("unknown kid %s", jwtToken.Header.Kid)
 	} else {
-		for _, key := range jwtPlugin.keys {
+		for kid, key := range jwtPlugin.keys {
+			if !keyFitsAlg(key, jwtToken.Header.Alg) {
+				continue
+			}
 			err := a.verify(key, a.hash, jwtToken.Plaintext, jwtToken.Signature)
 			if err == nil {
+				jwtToken.KeyID = kid
 				return nil
 			}
 		}
@@ -518,69 +2942,410 @@ func (jwtPlugin *JwtPlugin) VerifyToken(jwtToken *JWT) error {
 	}
 }
 
+// IsForbidden tells whether an error of CheckToken or CheckOpa denies an authenticated request, rather than
+// rejecting its token or failing to query OPA.
+func IsForbidden(err error) bool {
+	var forbidden *forbiddenError
+	return errors.As(err, &forbidden)
+}
+
 func (jwtPlugin *JwtPlugin) CheckOpa(request *http.Request, token *JWT) error {
-	opaPayload, err := toOPAPayload(request)
-	if err != nil {
-		return err
-	}
-	if token != nil {
-		opaPayload.Input.JWTHeader = token.Header
-		opaPayload.Input.JWTPayload = token.Payload
-	}
-	authPayloadAsJSON, err := json.Marshal(opaPayload)
-	if err != nil {
-		return err
+	_, err := jwtPlugin.checkOpa(request, token, make(http.Header))
+	return err
+}
+
+func (jwtPlugin *JwtPlugin) checkOpa(request *http.Request, token *JWT, responseHeader http.Header) (*UpstreamDecision, error) {
+	opaSpan := jwtPlugin.startSpan(request, "CheckOpa")
+	defer opaSpan.end()
+	// requests with a body are never cached, the policy may depend on it
+	includeBody := jwtPlugin.includeBody(request)
+	cacheKey := ""
+	if jwtPlugin.opaCache != nil && (!includeBody || request.Body == nil || request.Body == http.NoBody) {
+		cacheKey = jwtPlugin.decisionCacheKey(request, token)
 	}
-	authResponse, err := http.Post(jwtPlugin.opaUrl, "application/json", bytes.NewBuffer(authPayloadAsJSON))
-	if err != nil {
-		return err
+	var body []byte
+	cached := false
+	if cacheKey != "" {
+		body, cached = jwtPlugin.opaCache.get(cacheKey)
 	}
-	body, err := ioutil.ReadAll(authResponse.Body)
-	if err != nil {
-		return err
+	if !cached {
+		query := func() ([]byte, error) {
+			return jwtPlugin.queryOpa(request, token, includeBody, opaSpan.traceparent())
+		}
+		var err error
+		if cacheKey != "" {
+			// concurrent requests with the same key share a single query, which fills the cache
+			body, err = jwtPlugin.opaCache.do(cacheKey, query)
+		} else {
+			body, err = query()
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 	var result Response
-	err = json.Unmarshal(body, &result)
+	err := json.Unmarshal(body, &result)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(result.Result) == 0 {
-		return fmt.Errorf("OPA result invalid")
+		return nil, fmt.Errorf("OPA result invalid")
+	}
+	if jwtPlugin.opaResultSchema != nil {
+		// a result breaking the contract is handled like an unavailable OPA
+		var document struct {
+			Result interface{} `json:"result"`
+		}
+		_ = json.Unmarshal(body, &document)
+		if err = jwtPlugin.opaResultSchema.validate("result", document.Result); err != nil {
+			return nil, fmt.Errorf("%w: OPA result violates the schema: %v", errOpaUnavailable, err)
+		}
 	}
 	fieldResult, ok := result.Result[jwtPlugin.opaAllowField]
 	if !ok {
-		return fmt.Errorf("OPA result missing: %v", jwtPlugin.opaAllowField)
+		return nil, fmt.Errorf("OPA result missing: %v", jwtPlugin.opaAllowField)
 	}
 	var allow bool
 	if err = json.Unmarshal(fieldResult, &allow); err != nil {
-		return err
+		return nil, err
+	}
+	for k, v := range jwtPlugin.opaResponseHeaders {
+		if value, ok := resultValue(result.Result, v); ok && value != nil {
+			responseHeader.Set(k, headerValue(value)) // add OPA result to the client response
+		}
 	}
 	if !allow {
-		return fmt.Errorf("%s", body)
+		err := &forbiddenError{msg: string(body), reason: denyReason(result)}
+		if jwtPlugin.envoyExtAuthz {
+			return nil, envoyDenied(parseEnvoyResult(body), err)
+		}
+		return nil, err
+	}
+	if jwtPlugin.envoyExtAuthz {
+		envoyAllowed(parseEnvoyResult(body), request, responseHeader)
+	}
+	decision := UpstreamDecision{Source: jwtPlugin.opaUrl, Middleware: jwtPlugin.name, Allow: allow, Result: result.Result}
+	if token != nil {
+		decision.Claims = token.Payload
 	}
 	for k, v := range jwtPlugin.opaHeaders {
-		var value string
-		if err = json.Unmarshal(result.Result[v], &value); err == nil {
-			request.Header.Add(k, value) // add OPA result as an HTTP header
+		if value, ok := resultValue(result.Result, v); ok && value != nil {
+			request.Header.Add(k, headerValue(value)) // add OPA result as an HTTP header
+		}
+	}
+	return &decision, nil
+}
+
+// resultValue looks up a field of the OPA result, either a top-level field or a dot-path (e.g. user.tenant.id).
+func resultValue(result map[string]json.RawMessage, field string) (interface{}, bool) {
+	name, rest := field, ""
+	if _, ok := result[field]; !ok {
+		if i := strings.Index(field, "."); i >= 0 {
+			name, rest = field[:i], field[i+1:]
+		}
+	}
+	raw, ok := result[name]
+	if !ok {
+		return nil, false
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, false
+	}
+	if rest == "" {
+		return value, true
+	}
+	return valueAtPath(value, rest)
+}
+
+// valueAtPath walks the dot-separated path through nested JSON objects. Array elements are addressed by index.
+func valueAtPath(value interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// headerValue converts a JSON value into a header value: strings are used as-is, other values are JSON encoded.
+func headerValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// queryOpa posts the OPA input of the request and returns the response body.
+func (jwtPlugin *JwtPlugin) queryOpa(request *http.Request, token *JWT, includeBody bool, traceparent string) ([]byte, error) {
+	opaPayload, err := jwtPlugin.toOPAPayload(request, includeBody)
+	if err != nil {
+		return nil, err
+	}
+	if token != nil {
+		opaPayload.Input.JWTHeader = token.Header
+		opaPayload.Input.JWTPayload = token.Payload
+	}
+	opaPayload.Input.Upstream = jwtPlugin.upstreamInput(request)
+	opaPayload.Input.Metadata = jwtPlugin.opaMetadata
+	opaPayload.Input.Middleware = jwtPlugin.name
+	if jwtPlugin.opaIncludeToken && token != nil {
+		opaPayload.Input.Token = token.Raw
+	}
+	client := jwtPlugin.remoteAddr(request).Client
+	opaPayload.Input.Client = &client
+	authPayloadAsJSON, err := json.Marshal(opaPayload)
+	if err != nil {
+		return nil, err
+	}
+	opaUrl, err := jwtPlugin.expandOpaUrl(request, token)
+	if err != nil {
+		return nil, err
+	}
+	return jwtPlugin.postOpa(opaUrl, authPayloadAsJSON, traceparent)
+}
+
+// denyReason extracts the explanation of a denial from the `reason` or `errors` field of the OPA result.
+func denyReason(result Response) string {
+	var reason string
+	if err := json.Unmarshal(result.Result["reason"], &reason); err == nil && reason != "" {
+		return reason
+	}
+	var errs []string
+	if err := json.Unmarshal(result.Result["errors"], &errs); err == nil {
+		return strings.Join(errs, "; ")
+	}
+	if err := json.Unmarshal(result.Result["errors"], &reason); err == nil {
+		return reason
+	}
+	return ""
+}
+
+// upstreamInput collects the decisions and headers of earlier middlewares, returns nil when there are none.
+func (jwtPlugin *JwtPlugin) upstreamInput(request *http.Request) *UpstreamInput {
+	decisions, _ := request.Context().Value(upstreamDecisionsKey{}).([]UpstreamDecision)
+	headers := make(map[string]string)
+	for _, name := range jwtPlugin.opaUpstreamHeaders {
+		if value := request.Header.Get(name); value != "" {
+			headers[name] = value
+		}
+	}
+	if len(decisions) == 0 && len(headers) == 0 {
+		return nil
+	}
+	return &UpstreamInput{Decisions: decisions, Headers: headers}
+}
+
+// opaFailOpen tells whether the request is allowed when OPA is unavailable.
+func (jwtPlugin *JwtPlugin) opaFailOpen(request *http.Request) bool {
+	switch jwtPlugin.opaFailureMode {
+	case "open":
+		return true
+	case "open-readonly":
+		return request.Method == http.MethodGet || request.Method == http.MethodHead
+	default:
+		return false
+	}
+}
+
+// expandOpaUrl returns the OPA URL for the request, expanding the OpaUrl template when configured.
+func (jwtPlugin *JwtPlugin) expandOpaUrl(request *http.Request, token *JWT) (string, error) {
+	if jwtPlugin.opaUrlTemplate == nil {
+		return jwtPlugin.opaUrl, nil
+	}
+	data := opaUrlData{Host: request.Host, Method: request.Method, Path: request.URL.Path}
+	if token != nil {
+		data.Claims = token.Payload
+	}
+	var opaUrl strings.Builder
+	if err := jwtPlugin.opaUrlTemplate.Execute(&opaUrl, data); err != nil {
+		return "", fmt.Errorf("failed to expand OpaUrl: %v", err)
+	}
+	if err := jwtPlugin.checkOpaUrl(opaUrl.String()); err != nil {
+		return "", err
+	}
+	return opaUrl.String(), nil
+}
+
+// templateActions matches the actions of a template, e.g. {{ .Host }}.
+var templateActions = regexp.MustCompile(`(?s){{.*?}}`)
+
+// checkOpaUrl verifies that the values of the request and the claims expanded into the OpaUrl don't leave the
+// policy addressed by the template, e.g. with ../ segments or by starting a query.
+func (jwtPlugin *JwtPlugin) checkOpaUrl(opaUrl string) error {
+	prefix := jwtPlugin.opaUrl[:strings.Index(jwtPlugin.opaUrl, "{{")]
+	if !strings.HasPrefix(opaUrl, prefix) {
+		return fmt.Errorf("expanded OpaUrl %s leaves %s", opaUrl, prefix)
+	}
+	for _, c := range []string{"?", "#"} {
+		if strings.Count(opaUrl, c) != strings.Count(jwtPlugin.opaUrlStatic, c) {
+			return fmt.Errorf("expanded OpaUrl %s has an unexpected %s", opaUrl, c)
+		}
+	}
+	u, err := url.Parse(opaUrl)
+	if err != nil {
+		return fmt.Errorf("invalid expanded OpaUrl %s: %v", opaUrl, err)
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("expanded OpaUrl %s has a relative path", opaUrl)
 		}
 	}
 	return nil
 }
 
-func (jwtPlugin *JwtPlugin) log(msg ...interface{}) {
-	if jwtPlugin.logging {
-		fmt.Println(append([]interface{}{"jwt_plugin: "}, msg...))
+// postOpa posts the payload to OPA, retrying on connection errors and 5xx responses
+// with an exponential backoff. The traceparent (when not empty) propagates the trace of the request.
+func (jwtPlugin *JwtPlugin) postOpa(opaUrl string, payload []byte, traceparent string) ([]byte, error) {
+	if wait := jwtPlugin.opaThrottle.remaining(); wait > 0 {
+		return nil, &throttledError{destination: "OPA", retryAfter: wait}
+	}
+	backoff := jwtPlugin.opaRetryBackoff
+	for attempt := 0; ; attempt++ {
+		body, retry, err := jwtPlugin.postOpaOnce(opaUrl, payload, traceparent)
+		var throttled *throttledError
+		if errors.As(err, &throttled) {
+			jwtPlugin.opaThrottle.backoff(throttled.retryAfter)
+			return nil, err
+		}
+		if !retry {
+			return body, err
+		}
+		if attempt >= jwtPlugin.opaRetries {
+			return nil, fmt.Errorf("%w: %v", errOpaUnavailable, err)
+		}
+		jwtPlugin.logf("warn", "retrying OPA request: %v", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (jwtPlugin *JwtPlugin) postOpaOnce(opaUrl string, payload []byte, traceparent string) ([]byte, bool, error) {
+	authRequest, err := http.NewRequest(http.MethodPost, opaUrl, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, false, err
+	}
+	authRequest.Header.Set("Content-Type", "application/json")
+	if traceparent != "" {
+		authRequest.Header.Set("traceparent", traceparent)
+	}
+	for k, v := range jwtPlugin.opaAuthHeaders {
+		authRequest.Header.Set(k, v)
+	}
+	if jwtPlugin.faults.opaTimeout() {
+		time.Sleep(jwtPlugin.opaClient.Timeout)
+		return nil, true, fmt.Errorf("fault injection: OPA request timed out after %s", jwtPlugin.opaClient.Timeout)
+	}
+	authResponse, err := jwtPlugin.opaClient.Do(authRequest)
+	if err != nil {
+		return nil, true, err
+	}
+	defer authResponse.Body.Close()
+	body, err := ioutil.ReadAll(authResponse.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if wait, ok := retryAfter(authResponse); ok {
+		return nil, false, &throttledError{destination: "OPA", retryAfter: wait}
+	}
+	if authResponse.StatusCode >= http.StatusInternalServerError || authResponse.StatusCode == http.StatusTooManyRequests {
+		return nil, true, fmt.Errorf("OPA returned status %d", authResponse.StatusCode)
+	}
+	return body, false, nil
+}
+
+// logStartup prints a single structured record describing the enabled features, regardless of the logging setting.
+func (jwtPlugin *JwtPlugin) logStartup() {
+	algorithms := []string{jwtPlugin.alg}
+	if jwtPlugin.alg == "" {
+		algorithms = make([]string, 0, len(tokenAlgorithms))
+		for alg := range tokenAlgorithms {
+			algorithms = append(algorithms, alg)
+		}
+		sort.Strings(algorithms)
+	}
+	event := StartupEvent{
+		Level:           "info",
+		Msg:             "jwt plugin started",
+		Time:            time.Now(),
+		Middleware:      jwtPlugin.name,
+		Algorithms:      algorithms,
+		Issuer:          jwtPlugin.iss,
+		Audiences:       jwtPlugin.audiences,
+		StaticKeys:      jwtPlugin.keyCount(),
+		JwksEndpoints:   len(jwtPlugin.jwkEndpoints),
+		Opa:             jwtPlugin.opaUrl != "",
+		OpaCache:        jwtPlugin.opaCache != nil,
+		MagicToken:      jwtPlugin.enableMagicToken,
+		EmergencyTokens: len(jwtPlugin.emergencyTokens),
+		TrustedIdentity: jwtPlugin.trustedIdentityHeader != "",
+		Anonymous:       jwtPlugin.anonymousIdentity,
+		ValidateExpiry:  jwtPlugin.validateExpiry,
+		FaultInjection:  jwtPlugin.faults != nil,
 	}
+	if event.Opa {
+		event.OpaFailureMode = jwtPlugin.opaFailureMode
+	}
+	jwtPlugin.writeLog(event.Level, &event)
 }
 
+// ForwardError rejects the request according to the ErrorMode: the client receives the status code, or the
+// request is passed to the next handler with the error in the ForwardAuthErrorHeader.
 func (jwtPlugin *JwtPlugin) ForwardError(rw http.ResponseWriter, msg string, statusCode int, origReq *http.Request) {
-	rw.Header().Set(jwtPlugin.forwardAuthErrorHeader, msg)
-	origReq.Header.Set(jwtPlugin.forwardAuthErrorHeader, msg)
+	if jwtPlugin.errorMode == "forward-with-error-header" {
+		jwtPlugin.forwardError(rw, msg, origReq)
+		return
+	}
+	jwtPlugin.writeError(rw, msg, statusCode, nil)
+}
+
+// writeError ends the middleware chain with the error response, the request is left untouched.
+func (jwtPlugin *JwtPlugin) writeError(rw http.ResponseWriter, msg string, statusCode int, body []byte) {
+	if jwtPlugin.forwardAuthErrorHeader != "" {
+		rw.Header().Set(jwtPlugin.forwardAuthErrorHeader, msg)
+	}
 	rw.WriteHeader(statusCode)
+	if len(body) > 0 {
+		_, _ = rw.Write(body)
+	}
+}
+
+// forwardError passes the rejected request to the next handler, which responds to the client and can act on the
+// error in the ForwardAuthErrorHeader. The response is left to the next handler.
+func (jwtPlugin *JwtPlugin) forwardError(rw http.ResponseWriter, msg string, origReq *http.Request) {
+	origReq.Header.Set(jwtPlugin.forwardAuthErrorHeader, msg)
 	jwtPlugin.next.ServeHTTP(rw, origReq)
 }
 
-func toOPAPayload(request *http.Request) (*Payload, error) {
+// includeBody tells whether the body of the request is added to the OPA input.
+func (jwtPlugin *JwtPlugin) includeBody(request *http.Request) bool {
+	if !jwtPlugin.opaIncludeBody {
+		return false
+	}
+	if len(jwtPlugin.opaBodyTypes) == 0 {
+		return true
+	}
+	contentType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return containsFold(jwtPlugin.opaBodyTypes, contentType)
+}
+
+func (jwtPlugin *JwtPlugin) toOPAPayload(request *http.Request, includeBody bool) (*Payload, error) {
 	input := &PayloadInput{
 		Host:       request.Host,
 		Method:     request.Method,
@@ -588,11 +3353,25 @@ func toOPAPayload(request *http.Request) (*Payload, error) {
 		Parameters: request.URL.Query(),
 		Headers:    request.Header,
 	}
+	if !includeBody {
+		return &Payload{Input: input}, nil
+	}
 	contentType, params, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
 	if err == nil {
+		threshold := jwtPlugin.opaBodySpillThreshold
+		if threshold > 0 && strings.HasPrefix(contentType, "multipart/") && (jwtPlugin.opaBodyLimit <= 0 || jwtPlugin.opaBodyLimit > threshold) {
+			var captured io.Reader
+			captured, request.Body, input.BodyTruncated, err = drainBodySpill(request.Body, jwtPlugin.opaBodyLimit, threshold)
+			if err == nil && !input.BodyTruncated && (contentType == "multipart/form-data" || contentType == "multipart/mixed") {
+				if input.Form, err = readMultipartForm(captured, params["boundary"], threshold); err != nil {
+					return nil, err
+				}
+			}
+			return &Payload{Input: input}, nil
+		}
 		var save []byte
-		save, request.Body, err = drainBody(request.Body)
-		if err == nil {
+		save, request.Body, input.BodyTruncated, err = drainBodyLimit(request.Body, jwtPlugin.opaBodyLimit)
+		if err == nil && !input.BodyTruncated {
 			if contentType == "application/json" {
 				err = json.Unmarshal(save, &input.Body)
 				if err != nil {
@@ -604,33 +3383,214 @@ func toOPAPayload(request *http.Request) (*Payload, error) {
 					return nil, err
 				}
 			} else if contentType == "multipart/form-data" || contentType == "multipart/mixed" {
-				boundary := params["boundary"]
-				mr := multipart.NewReader(bytes.NewReader(save), boundary)
-				f, err := mr.ReadForm(32 << 20)
+				input.Form, err = readMultipartForm(bytes.NewReader(save), params["boundary"], 32<<20)
 				if err != nil {
 					return nil, err
 				}
-
-				input.Form = make(url.Values)
-				for k, v := range f.Value {
-					input.Form[k] = append(input.Form[k], v...)
-				}
+			} else if jwtPlugin.opaRawBody == "string" {
+				input.RawBody = string(save)
+			} else if jwtPlugin.opaRawBody == "base64" {
+				input.RawBody = base64.StdEncoding.EncodeToString(save)
 			}
 		}
 	}
 	return &Payload{Input: input}, nil
 }
 
+// readMultipartForm returns the values of a multipart form, files larger than maxMemory are stored
+// in temporary files until the form is parsed.
+func readMultipartForm(r io.Reader, boundary string, maxMemory int64) (url.Values, error) {
+	f, err := multipart.NewReader(r, boundary).ReadForm(maxMemory)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.RemoveAll() }()
+	form := make(url.Values)
+	for k, v := range f.Value {
+		form[k] = append(form[k], v...)
+	}
+	return form, nil
+}
+
+// matchAnyPath tells whether the path matches one of the patterns.
+func matchAnyPath(patterns []string, requestPath string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath matches a request path against a glob pattern, where `*` matches a single
+// path segment (or part of it) and `**` matches any number of segments.
+func matchPath(pattern string, requestPath string) bool {
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(requestPath, "/"), "/"))
+}
+
+func matchSegments(patterns []string, segments []string) bool {
+	if len(patterns) == 0 {
+		return len(segments) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(patterns[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, err := path.Match(patterns[0], segments[0]); err != nil || !ok {
+		return false
+	}
+	return matchSegments(patterns[1:], segments[1:])
+}
+
+// bodyBuffers pools the buffers capturing request bodies. A buffer returns to the pool when the replayed body
+// is closed, which the upstream transport does once the body is sent.
+var bodyBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// maxPooledBodyBuffer keeps the buffers of exceptionally large bodies out of the pool.
+const maxPooledBodyBuffer = 1 << 20
+
+var errBodyClosed = errors.New("read on closed body")
+
+func releaseBodyBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() <= maxPooledBodyBuffer {
+		bodyBuffers.Put(buffer)
+	}
+}
+
+// pooledBody replays a body captured in a pooled buffer, followed by the rest of the original body.
+type pooledBody struct {
+	lock   sync.Mutex
+	buffer *bytes.Buffer
+	r      io.Reader
+	c      io.Closer
+}
+
+func (p *pooledBody) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.buffer == nil {
+		return 0, errBodyClosed
+	}
+	return p.r.Read(b)
+}
+
+func (p *pooledBody) Close() error {
+	p.lock.Lock()
+	if p.buffer != nil {
+		releaseBodyBuffer(p.buffer)
+		p.buffer = nil
+	}
+	p.lock.Unlock()
+	return p.c.Close()
+}
+
+// drainBody reads the body into a pooled buffer and returns its content, which is only valid until
+// the returned replacement body is closed.
 func drainBody(b io.ReadCloser) ([]byte, io.ReadCloser, error) {
 	if b == nil || b == http.NoBody {
 		// No copying needed. Preserve the magic sentinel meaning of NoBody.
 		return nil, http.NoBody, nil
 	}
-	body, err := ioutil.ReadAll(b)
-	if err != nil {
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	if _, err := io.Copy(buffer, b); err != nil {
+		releaseBodyBuffer(buffer)
 		return nil, b, err
 	}
-	return body, NopCloser(bytes.NewReader(body), b), nil
+	body := buffer.Bytes()
+	return body, &pooledBody{buffer: buffer, r: bytes.NewReader(body), c: b}, nil
+}
+
+// drainBodyLimit drains the body like drainBody, but reads at most limit bytes (when positive).
+// When the body is larger, nothing is returned and the body is left to be streamed to the upstream.
+func drainBodyLimit(b io.ReadCloser, limit int64) ([]byte, io.ReadCloser, bool, error) {
+	if limit <= 0 || b == nil || b == http.NoBody {
+		body, b, err := drainBody(b)
+		return body, b, false, err
+	}
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	if _, err := io.Copy(buffer, io.LimitReader(b, limit+1)); err != nil {
+		releaseBodyBuffer(buffer)
+		return nil, b, false, err
+	}
+	body := buffer.Bytes()
+	if int64(len(body)) > limit {
+		return nil, &pooledBody{buffer: buffer, r: io.MultiReader(bytes.NewReader(body), b), c: b}, true, nil
+	}
+	return body, &pooledBody{buffer: buffer, r: bytes.NewReader(body), c: b}, false, nil
+}
+
+// drainBodySpill drains the body like drainBodyLimit, but spills bodies larger than the threshold into a
+// temporary file instead of memory. It returns a reader of the captured body, which is only valid until the
+// returned replacement body is closed.
+func drainBodySpill(b io.ReadCloser, limit int64, threshold int64) (io.Reader, io.ReadCloser, bool, error) {
+	if b == nil || b == http.NoBody {
+		return bytes.NewReader(nil), http.NoBody, false, nil
+	}
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	if _, err := io.Copy(buffer, io.LimitReader(b, threshold+1)); err != nil {
+		releaseBodyBuffer(buffer)
+		return nil, b, false, err
+	}
+	if int64(buffer.Len()) <= threshold {
+		body := buffer.Bytes()
+		return bytes.NewReader(body), &pooledBody{buffer: buffer, r: bytes.NewReader(body), c: b}, false, nil
+	}
+	file, err := ioutil.TempFile("", "traefik-jwt-plugin-body-")
+	if err != nil {
+		// replay what was read, the body isn't captured
+		body := buffer.Bytes()
+		return nil, &pooledBody{buffer: buffer, r: io.MultiReader(bytes.NewReader(body), b), c: b}, false, err
+	}
+	spilled := &spilledBody{file: file, c: b}
+	// the file is removed right away where open files can be removed, so it never outlives the process
+	if os.Remove(file.Name()) != nil {
+		spilled.name = file.Name()
+	}
+	rest := io.Reader(b)
+	if limit > 0 {
+		rest = io.LimitReader(b, limit+1-int64(buffer.Len()))
+	}
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(buffer.Bytes()), rest))
+	releaseBodyBuffer(buffer)
+	if err != nil {
+		_ = spilled.Close()
+		return nil, b, false, err
+	}
+	if limit > 0 && size > limit {
+		spilled.r = io.MultiReader(io.NewSectionReader(file, 0, size), b)
+		return nil, spilled, true, nil
+	}
+	spilled.r = io.NewSectionReader(file, 0, size)
+	return io.NewSectionReader(file, 0, size), spilled, false, nil
+}
+
+// spilledBody replays a body captured in a temporary file, which is removed when the body is closed.
+type spilledBody struct {
+	file *os.File
+	// name of the file when it couldn't be removed while open
+	name string
+	r    io.Reader
+	c    io.Closer
+}
+
+func (s *spilledBody) Read(b []byte) (int, error) { return s.r.Read(b) }
+
+func (s *spilledBody) Close() error {
+	_ = s.file.Close()
+	if s.name != "" {
+		_ = os.Remove(s.name)
+	}
+	return s.c.Close()
 }
 
 func NopCloser(r io.Reader, c io.Closer) io.ReadCloser {
@@ -670,6 +3630,22 @@ var tokenAlgorithms = map[string]tokenAlgorithm{
 	"HS512": {crypto.SHA512, verifyHMAC},
 }
 
+// keyFitsAlg tells whether the key belongs to the family of the algorithm, e.g. an HMAC secret can't verify RS256.
+func keyFitsAlg(key interface{}, alg string) bool {
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		_, ok := key.([]byte)
+		return ok
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case strings.HasPrefix(alg, "ES"):
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	}
+	return false
+}
+
 // errSignatureNotVerified is returned when a signature cannot be verified.
 func verifyHMAC(key interface{}, hash crypto.Hash, payload []byte, signature []byte) error {
 	macKey, ok := key.([]byte)
@@ -699,7 +3675,10 @@ func verifyAsymmetric(verify tokenVerifyAsymmetricFunction) tokenVerifyFunction
 }
 
 func verifyRSAPKCS(key interface{}, hash crypto.Hash, digest []byte, signature []byte) error {
-	publicKeyRsa := key.(*rsa.PublicKey)
+	publicKeyRsa, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("incorrect public key type")
+	}
 	if err := rsa.VerifyPKCS1v15(publicKeyRsa, hash, digest, signature); err != nil {
 		return fmt.Errorf("token verification failed (RSAPKCS)")
 	}
@@ -0,0 +1,69 @@
+package traefik_jwt_plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// keyFile is a key loaded from a file:// entry of the Keys, which is reloaded when the file changes.
+type keyFile struct {
+	path string
+	// publicKid identifies a public key, it is kept across reloads
+	publicKid string
+	kids      []string
+	modTime   time.Time
+	size      int64
+}
+
+// loadKeyFile reads the keys of the file (PEM, JWK or JWKS), replacing the keys loaded from the file before.
+func (jwtPlugin *JwtPlugin) loadKeyFile(file *keyFile) error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return fmt.Errorf("failed to read the key file: %v", err)
+	}
+	data, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		return fmt.Errorf("failed to read the key file: %v", err)
+	}
+	keys, err := parseKeyDocument(data, file.publicKid)
+	if err != nil {
+		return fmt.Errorf("%v in file://%s", err, file.path)
+	}
+	for _, kid := range file.kids {
+		if _, ok := keys[kid]; !ok {
+			jwtPlugin.RemoveKey(kid)
+		}
+	}
+	file.kids = file.kids[:0]
+	for kid, key := range keys {
+		jwtPlugin.setKey(kid, key)
+		file.kids = append(file.kids, kid)
+	}
+	file.modTime, file.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// watchKeyFiles polls the key files and reloads the changed files, so rotated keys are used without
+// restarting Traefik. A file which fails to load keeps its previous key.
+func (jwtPlugin *JwtPlugin) watchKeyFiles(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, file := range jwtPlugin.keyFiles {
+			info, err := os.Stat(file.path)
+			if err != nil {
+				jwtPlugin.logf("error", "failed to check the key file %s: %v", file.path, err)
+				continue
+			}
+			if info.ModTime().Equal(file.modTime) && info.Size() == file.size {
+				continue
+			}
+			if err = jwtPlugin.loadKeyFile(file); err != nil {
+				jwtPlugin.logf("error", "failed to reload the key file, keeping the previous key: %v", err)
+				continue
+			}
+			jwtPlugin.logf("info", "reloaded the key file %s", file.path)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package traefik_jwt_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Logger receives the log entries of the plugin: LogEvent, StartupEvent and other records, which all marshal to JSON.
+// Only entries of enabled levels are passed.
+type Logger interface {
+	Log(level string, entry interface{})
+}
+
+// stdoutLogger writes the entries to the standard output as JSON lines.
+type stdoutLogger struct{}
+
+func (stdoutLogger) Log(_ string, entry interface{}) {
+	jsonEntry, _ := json.Marshal(entry)
+	fmt.Println(string(jsonEntry))
+}
+
+// SetLogger routes the logs of the plugin (and its HostOverrides) to the logger instead of the standard output,
+// for applications embedding the plugin. Entries logged before, like the StartupEvent, went to the previous logger.
+func (jwtPlugin *JwtPlugin) SetLogger(logger Logger) {
+	jwtPlugin.loggerLock.Lock()
+	jwtPlugin.logger = logger
+	jwtPlugin.loggerLock.Unlock()
+	for _, override := range jwtPlugin.hostPlugins {
+		if plugin, ok := override.plugin.(*JwtPlugin); ok {
+			plugin.SetLogger(logger)
+		}
+	}
+}
+
+// logLevels orders the levels of the LogLevel setting by severity.
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// logRecord is a log entry which isn't about a request.
+type logRecord struct {
+	Level      string    `json:"level"`
+	Msg        string    `json:"msg"`
+	Time       time.Time `json:"time"`
+	Middleware string    `json:"middleware,omitempty"`
+}
+
+// parseLogLevel returns the severity of the LogLevel, which defaults to debug when Logging is enabled, otherwise info.
+func parseLogLevel(config *Config) (int, error) {
+	level := config.LogLevel
+	if level == "" {
+		level = "info"
+		if config.Logging {
+			level = "debug"
+		}
+	}
+	severity, ok := logLevels[level]
+	if !ok {
+		return 0, fmt.Errorf("invalid LogLevel %s, expecting debug, info, warn or error", level)
+	}
+	return severity, nil
+}
+
+// logEnabled tells whether entries of the level are logged.
+func (jwtPlugin *JwtPlugin) logEnabled(level string) bool {
+	return logLevels[level] >= jwtPlugin.logLevel
+}
+
+// logf logs a message which isn't about a request.
+func (jwtPlugin *JwtPlugin) logf(level string, format string, args ...interface{}) {
+	if !jwtPlugin.logEnabled(level) {
+		return
+	}
+	jwtPlugin.writeLog(level, &logRecord{
+		Level:      level,
+		Msg:        fmt.Sprintf(format, args...),
+		Time:       time.Now(),
+		Middleware: jwtPlugin.name,
+	})
+}
+
+// logEvent logs a message about a request, with the client, the request ID and the subject and key of the token.
+func (jwtPlugin *JwtPlugin) logEvent(level string, msg string, request *http.Request, jwtToken *JWT) {
+	if !jwtPlugin.logEnabled(level) {
+		return
+	}
+	jwtPlugin.writeLog(level, jwtPlugin.newLogEvent(level, msg, request, jwtToken))
+}
+
+// audit logs the decision about a request when the AuditLog is enabled, regardless of the LogLevel,
+// and ships it to the DecisionLogUrl. The record is nil for requests which bypassed the checks.
+func (jwtPlugin *JwtPlugin) audit(request *http.Request, record *requestRecord, decision string, reason string) {
+	if !jwtPlugin.auditLog && jwtPlugin.decisionLog == nil {
+		return
+	}
+	if record == nil {
+		record = &requestRecord{}
+	}
+	event := jwtPlugin.newLogEvent("info", "authorization decision", request, record.token)
+	event.Method = request.Method
+	event.Path = request.URL.Path
+	event.Decision = decision
+	event.Reason = reason
+	event.OpaLatencyMs = float64(record.opaLatency) / float64(time.Millisecond)
+	if record.token != nil {
+		if iss, ok := record.token.Payload["iss"].(string); ok {
+			event.Iss = iss
+		}
+		if jti, ok := record.token.Payload["jti"].(string); ok {
+			event.Jti = jti
+		}
+	}
+	if jwtPlugin.auditLog {
+		jwtPlugin.writeLog("info", event)
+	}
+	if jwtPlugin.decisionLog != nil {
+		jwtPlugin.decisionLog.send(event)
+	}
+}
+
+func (jwtPlugin *JwtPlugin) newLogEvent(level string, msg string, request *http.Request, jwtToken *JWT) *LogEvent {
+	event := &LogEvent{
+		Level:      level,
+		Msg:        msg,
+		Time:       time.Now(),
+		Network:    jwtPlugin.remoteAddr(request),
+		URL:        request.URL.String(),
+		Middleware: jwtPlugin.name,
+		RequestID:  request.Header.Get("X-Request-Id"),
+	}
+	if jwtToken != nil {
+		event.Sub = fmt.Sprint(jwtToken.Payload["sub"])
+		event.Kid = jwtToken.KeyID
+	}
+	return event
+}
+
+// writeLog passes the entry to the Logger, by default the standard output.
+func (jwtPlugin *JwtPlugin) writeLog(level string, entry interface{}) {
+	jwtPlugin.loggerLock.RLock()
+	logger := jwtPlugin.logger
+	jwtPlugin.loggerLock.RUnlock()
+	if logger == nil {
+		logger = stdoutLogger{}
+	}
+	logger.Log(level, entry)
+}
@@ -0,0 +1,142 @@
+package traefik_jwt_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit throttles the requests of each subject with a token bucket, so noisy tenants are rejected at the edge
+// with 429 Too Many Requests and a Retry-After header.
+type RateLimit struct {
+	// Average is the number of requests per Period allowed to each subject, 0 disables the rate limiting
+	Average int
+	// Period of the Average, 1s by default
+	Period string
+	// Burst is the number of requests a subject may send at once, the Average by default
+	Burst int
+	// Claim identifying the subject, sub by default. Tokens without the claim are not limited.
+	Claim string
+	// Size bounds the number of tracked subjects, 10000 by default
+	Size int
+}
+
+// rateLimiter holds a token bucket per subject.
+type rateLimiter struct {
+	claim string
+	// rate is the number of requests per second refilled in the buckets
+	rate    float64
+	burst   float64
+	size    int
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(config RateLimit) (*rateLimiter, error) {
+	if config.Average == 0 {
+		return nil, nil
+	}
+	if config.Average < 0 {
+		return nil, fmt.Errorf("invalid RateLimit Average %d, expecting a positive number", config.Average)
+	}
+	period := time.Second
+	if config.Period != "" {
+		var err error
+		if period, err = time.ParseDuration(config.Period); err != nil {
+			return nil, fmt.Errorf("invalid RateLimit Period: %v", err)
+		}
+		if period <= 0 {
+			return nil, fmt.Errorf("invalid RateLimit Period %s, expecting a positive duration", config.Period)
+		}
+	}
+	burst := config.Burst
+	if burst <= 0 {
+		burst = config.Average
+	}
+	claim := config.Claim
+	if claim == "" {
+		claim = "sub"
+	}
+	size := config.Size
+	if size <= 0 {
+		size = 10000
+	}
+	return &rateLimiter{
+		claim:   claim,
+		rate:    float64(config.Average) / period.Seconds(),
+		burst:   float64(burst),
+		size:    size,
+		buckets: make(map[string]*bucket),
+	}, nil
+}
+
+// take consumes a request from the bucket of the subject, or returns how long the subject has to wait.
+func (limiter *rateLimiter) take(key string) (time.Duration, bool) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	b, ok := limiter.buckets[key]
+	if !ok {
+		limiter.evict(now)
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+	if b.tokens > limiter.burst {
+		b.tokens = limiter.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limiter.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// evict makes room for a new subject. Refilled buckets are dropped first, as they are the same as new buckets.
+func (limiter *rateLimiter) evict(now time.Time) {
+	if len(limiter.buckets) < limiter.size {
+		return
+	}
+	for k, b := range limiter.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, k)
+		}
+	}
+	if len(limiter.buckets) >= limiter.size {
+		// still full, evict an arbitrary subject
+		for k := range limiter.buckets {
+			delete(limiter.buckets, k)
+			break
+		}
+	}
+}
+
+// checkRateLimit rejects the requests of the subjects which exceeded the RateLimit.
+func (jwtPlugin *JwtPlugin) checkRateLimit(jwtToken *JWT) error {
+	if jwtPlugin.rateLimiter == nil || jwtToken == nil || jwtToken.Anonymous {
+		return nil
+	}
+	value, ok := valueAtPath(jwtToken.Payload, jwtPlugin.rateLimiter.claim)
+	if !ok {
+		return nil
+	}
+	key := fmt.Sprint(value)
+	if wait, ok := jwtPlugin.rateLimiter.take(key); !ok {
+		header := http.Header{}
+		header.Set("Retry-After", retryAfterSeconds(wait))
+		return &forbiddenError{
+			msg:    fmt.Sprintf("rate limit of %s exceeded", key),
+			reason: "rate limit exceeded",
+			status: http.StatusTooManyRequests,
+			header: header,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package traefik_jwt_plugin
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReplayStore records the jti of the tokens seen by the plugin, so single-use tokens are only accepted once.
+// Applications embedding the plugin can share the store between instances with SetReplayStore, e.g. in Redis.
+type ReplayStore interface {
+	// Seen records the key until expires, and tells whether it was already recorded
+	Seen(key string, expires time.Time) (bool, error)
+}
+
+// memoryReplayStore is the default ReplayStore of an instance, bounded to a number of keys.
+type memoryReplayStore struct {
+	lock sync.Mutex
+	size int
+	keys map[string]time.Time
+}
+
+func newMemoryReplayStore(size int) *memoryReplayStore {
+	if size <= 0 {
+		size = 100000
+	}
+	return &memoryReplayStore{size: size, keys: make(map[string]time.Time)}
+}
+
+func (store *memoryReplayStore) Seen(key string, expires time.Time) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	if seen, ok := store.keys[key]; ok && now.Before(seen) {
+		return true, nil
+	}
+	if len(store.keys) >= store.size {
+		for k, seen := range store.keys {
+			if now.After(seen) {
+				delete(store.keys, k)
+			}
+		}
+	}
+	// evicting a key which didn't expire would allow its replay
+	if len(store.keys) >= store.size {
+		return false, errors.New("replay store is full")
+	}
+	store.keys[key] = expires
+	return false, nil
+}
+
+// SetReplayStore replaces the store of the jti of the plugin (and its HostOverrides), which is only used
+// when PreventReplay is set.
+func (jwtPlugin *JwtPlugin) SetReplayStore(store ReplayStore) {
+	jwtPlugin.replayLock.Lock()
+	jwtPlugin.replayStore = store
+	jwtPlugin.replayLock.Unlock()
+	for _, override := range jwtPlugin.hostPlugins {
+		if plugin, ok := override.plugin.(*JwtPlugin); ok {
+			plugin.SetReplayStore(store)
+		}
+	}
+}
+
+// checkReplay rejects the tokens whose jti was already seen. The jti is recorded until the token expires,
+// tokens without jti or exp can't be protected and are rejected.
+func (jwtPlugin *JwtPlugin) checkReplay(jwtToken *JWT) error {
+	jti, _ := jwtToken.Payload["jti"].(string)
+	if jti == "" {
+		return errors.New("token has no jti")
+	}
+	exp, ok := jwtToken.Payload["exp"].(float64)
+	if !ok {
+		return errors.New("token has no exp")
+	}
+	// the token is accepted until the end of the clock skew
+	expires := time.Unix(int64(exp), 0).Add(jwtPlugin.clockSkew)
+	if time.Now().After(expires) {
+		return errors.New("token is expired")
+	}
+	iss, _ := jwtToken.Payload["iss"].(string)
+	jwtPlugin.replayLock.RLock()
+	store := jwtPlugin.replayStore
+	jwtPlugin.replayLock.RUnlock()
+	// the jti is unique per issuer
+	seen, err := store.Seen(iss+" "+jti, expires)
+	if err != nil {
+		return fmt.Errorf("checking replay of token %s: %v", jti, err)
+	}
+	if seen {
+		return fmt.Errorf("replay of token %s", jti)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package traefik_jwt_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// RevocationList is the document served by the RevocationUrl, listing the revoked tokens by jti, the subjects
+// whose tokens are all revoked and the kids whose signatures are no longer trusted.
+type RevocationList struct {
+	Jti []string `json:"jti"`
+	Sub []string `json:"sub"`
+	Kid []string `json:"kid"`
+}
+
+// revocations is the latest RevocationList fetched from the RevocationUrl.
+type revocations struct {
+	url    string
+	client *http.Client
+	lock   sync.RWMutex
+	jti    map[string]struct{}
+	sub    map[string]struct{}
+	kid    map[string]struct{}
+}
+
+func newRevocations(rawURL string, client *http.Client) (*revocations, error) {
+	if u, err := url.ParseRequestURI(rawURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid RevocationUrl %s, expecting an absolute URL", rawURL)
+	}
+	return &revocations{url: rawURL, client: client}, nil
+}
+
+func stringSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
+}
+
+// fetch replaces the revoked tokens by the current list of the RevocationUrl.
+func (r *revocations) fetch() (int, error) {
+	response, err := r.client.Get(r.url)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	var list RevocationList
+	if err = json.Unmarshal(body, &list); err != nil {
+		return 0, err
+	}
+	r.lock.Lock()
+	r.jti, r.sub, r.kid = stringSet(list.Jti), stringSet(list.Sub), stringSet(list.Kid)
+	r.lock.Unlock()
+	return len(list.Jti) + len(list.Sub) + len(list.Kid), nil
+}
+
+// check rejects the token when its jti, its subject or the kid of its key is revoked.
+func (r *revocations) check(jwtToken *JWT) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if jti, ok := jwtToken.Payload["jti"].(string); ok {
+		if _, revoked := r.jti[jti]; revoked {
+			return fmt.Errorf("token %s is revoked", jti)
+		}
+	}
+	if sub, ok := jwtToken.Payload["sub"].(string); ok {
+		if _, revoked := r.sub[sub]; revoked {
+			return fmt.Errorf("tokens of subject %s are revoked", sub)
+		}
+	}
+	if jwtToken.KeyID != "" {
+		if _, revoked := r.kid[jwtToken.KeyID]; revoked {
+			return fmt.Errorf("key %s is revoked", jwtToken.KeyID)
+		}
+	}
+	return nil
+}
+
+// watchRevocations polls the RevocationUrl, so compromised tokens are rejected before they expire.
+// A failed poll keeps the previous list.
+func (jwtPlugin *JwtPlugin) watchRevocations(interval time.Duration) {
+	for {
+		if count, err := jwtPlugin.revocations.fetch(); err != nil {
+			jwtPlugin.logf("error", "failed to fetch the revocation list %s, keeping the previous list: %v", jwtPlugin.revocations.url, err)
+		} else {
+			jwtPlugin.logf("debug", "fetched %d revocations from %s", count, jwtPlugin.revocations.url)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,123 @@
+package traefik_jwt_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema used to validate OPA results: type, enum, required,
+// properties, additionalProperties and items.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+}
+
+// newJSONSchema parses a schema, given either as JSON or as the path of a JSON file.
+func newJSONSchema(value string) (*jsonSchema, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		var err error
+		if data, err = ioutil.ReadFile(value); err != nil {
+			return nil, err
+		}
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// validate returns the first violation of the schema by the value, or nil.
+func (schema *jsonSchema) validate(path string, value interface{}) error {
+	if schema.Type != nil && !schema.matchesType(value) {
+		return fmt.Errorf("%s: expected type %v, got %s", path, schema.Type, jsonType(value))
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v not in enum %v", path, value, schema.Enum)
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %s", path, name)
+			}
+		}
+		for name, property := range v {
+			if propertySchema, ok := schema.Properties[name]; ok {
+				if err := propertySchema.validate(path+"."+name, property); err != nil {
+					return err
+				}
+			} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				return fmt.Errorf("%s: unexpected property %s", path, name)
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				if err := schema.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (schema *jsonSchema) matchesType(value interface{}) bool {
+	switch t := schema.Type.(type) {
+	case string:
+		return matchesJSONType(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesJSONType(s, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesJSONType(name string, value interface{}) bool {
+	if name == "integer" {
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	}
+	return name == jsonType(value)
+}
+
+// jsonType returns the JSON Schema type name of a decoded JSON value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
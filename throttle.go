@@ -0,0 +1,78 @@
+package traefik_jwt_plugin
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRetryAfter caps the Retry-After of a backend, so a misbehaving backend can't block requests for hours.
+const maxRetryAfter = time.Minute
+
+// throttle tracks the Retry-After of an outbound destination, calls are skipped until it passed.
+type throttle struct {
+	lock  sync.Mutex
+	until time.Time
+}
+
+// remaining returns how long calls to the destination are skipped.
+func (t *throttle) remaining() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return time.Until(t.until)
+}
+
+func (t *throttle) backoff(retryAfter time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.until = time.Now().Add(retryAfter)
+}
+
+// throttledError is returned when a destination asked to back off (429 or 503 with a Retry-After header).
+type throttledError struct {
+	destination string
+	retryAfter  time.Duration
+}
+
+func (err *throttledError) Error() string {
+	return fmt.Sprintf("%s throttled, retry after %s", err.destination, err.retryAfter)
+}
+
+// Unwrap makes a throttled OPA an unavailable OPA, which is handled according to the OpaFailureMode.
+func (err *throttledError) Unwrap() error {
+	return errOpaUnavailable
+}
+
+// retryAfter returns the Retry-After of a 429 or 503 response, either given in seconds or as an HTTP date.
+func retryAfter(response *http.Response) (time.Duration, bool) {
+	if response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if wait <= 0 {
+		return 0, false
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+// retryAfterSeconds formats the duration as the value of a Retry-After header, rounded up to whole seconds.
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,90 @@
+package traefik_jwt_plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// span is a stage of the request handling, a child of the span of the incoming W3C traceparent header.
+// Spans are reported in the logs, and the span of the OPA check is propagated to OPA.
+type span struct {
+	plugin   *JwtPlugin
+	name     string
+	traceID  string
+	spanID   string
+	parentID string
+	flags    string
+	start    time.Time
+}
+
+// SpanRecord is logged when a span ends. Only the Go standard library is available to plugins,
+// so spans are exported through the logs rather than an OpenTelemetry exporter.
+type SpanRecord struct {
+	Level        string    `json:"level"`
+	Msg          string    `json:"msg"`
+	Time         time.Time `json:"time"`
+	Middleware   string    `json:"middleware,omitempty"`
+	TraceID      string    `json:"traceId"`
+	SpanID       string    `json:"spanId"`
+	ParentSpanID string    `json:"parentSpanId"`
+	Name         string    `json:"name"`
+	Start        time.Time `json:"start"`
+	// DurationMs is the duration of the span in milliseconds
+	DurationMs float64 `json:"durationMs"`
+}
+
+// startSpan starts a child span of the traceparent of the request, or returns nil when tracing is
+// disabled or the request isn't traced.
+func (jwtPlugin *JwtPlugin) startSpan(request *http.Request, name string) *span {
+	if !jwtPlugin.tracing || request == nil {
+		return nil
+	}
+	parts := strings.Split(request.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil
+	}
+	return &span{
+		plugin:   jwtPlugin,
+		name:     name,
+		traceID:  parts[1],
+		spanID:   hex.EncodeToString(id),
+		parentID: parts[2],
+		flags:    parts[3],
+		start:    time.Now(),
+	}
+}
+
+// traceparent returns the W3C traceparent header identifying the span, for outbound requests.
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + s.traceID + "-" + s.spanID + "-" + s.flags
+}
+
+// end logs the span.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.plugin.writeLog("info", &SpanRecord{
+		Level:        "info",
+		Msg:          "span " + s.name,
+		Time:         now,
+		Middleware:   s.plugin.name,
+		TraceID:      s.traceID,
+		SpanID:       s.spanID,
+		ParentSpanID: s.parentID,
+		Name:         s.name,
+		Start:        s.start,
+		DurationMs:   float64(now.Sub(s.start)) / float64(time.Millisecond),
+	})
+}
@@ -0,0 +1,166 @@
+package traefik_jwt_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Transform is a step of the Transforms, which are applied in order to the headers of authenticated requests.
+type Transform struct {
+	// Action is copy (claim to header), drop (remove the header), rewrite (replace the matches of
+	// Regex in the header value by Replacement) or mint (header from the Template over the claims)
+	Action string
+	Header string
+	// Claim copied by the copy action, nested claims are addressed with dots, e.g. address.country.
+	// Array claims are joined with the ArrayClaimDelimiter.
+	Claim string
+	// Regex and Replacement of the rewrite action, the replacement may reference groups like $1
+	Regex       string
+	Replacement string
+	// Template of the mint action, e.g. {{.sub}}@{{.tenant}}. The header isn't set when a claim is missing.
+	Template string
+	// Target is request (the upstream request, default), response (the client response) or both
+	Target string
+	// Mode is append (add to existing values) or override (replace existing values, default)
+	Mode string
+}
+
+// transformer applies the Transforms, the JwtHeaders and JwtHeaderRules are copy transforms.
+type transformer struct {
+	rules []transformRule
+}
+
+type transformRule struct {
+	Transform
+	regex    *regexp.Regexp
+	template *template.Template
+	// delimiter joins the elements of copied array claims, JSON is used when empty
+	delimiter string
+}
+
+func newTransformer(transforms []Transform, delimiter string) (*transformer, error) {
+	t := &transformer{}
+	for _, transform := range transforms {
+		rule := transformRule{Transform: transform, delimiter: delimiter}
+		if rule.Target == "" {
+			rule.Target = "request"
+		}
+		if rule.Mode == "" {
+			rule.Mode = "override"
+		}
+		if rule.Header == "" {
+			return nil, fmt.Errorf("invalid %s transform, expecting a header", rule.Action)
+		}
+		if rule.Target != "request" && rule.Target != "response" && rule.Target != "both" {
+			return nil, fmt.Errorf("invalid target %s for transform of header %s, expecting request, response or both", rule.Target, rule.Header)
+		}
+		if rule.Mode != "append" && rule.Mode != "override" {
+			return nil, fmt.Errorf("invalid mode %s for transform of header %s, expecting append or override", rule.Mode, rule.Header)
+		}
+		var err error
+		switch rule.Action {
+		case "copy":
+			if rule.Claim == "" {
+				return nil, fmt.Errorf("invalid copy transform of header %s, expecting a claim", rule.Header)
+			}
+		case "drop":
+		case "rewrite":
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return nil, fmt.Errorf("invalid regex for transform of header %s: %v", rule.Header, err)
+			}
+		case "mint":
+			if rule.template, err = template.New(rule.Header).Option("missingkey=error").Parse(rule.Template); err != nil {
+				return nil, fmt.Errorf("invalid template for transform of header %s: %v", rule.Header, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid transform action %s for header %s, expecting copy, drop, rewrite or mint", rule.Action, rule.Header)
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return t, nil
+}
+
+// requestHeaders returns the headers set on the upstream request by copy and mint transforms.
+func (t *transformer) requestHeaders() []string {
+	var headers []string
+	for _, rule := range t.rules {
+		if (rule.Action == "copy" || rule.Action == "mint") && (rule.Target == "request" || rule.Target == "both") {
+			headers = append(headers, rule.Header)
+		}
+	}
+	return headers
+}
+
+// apply runs the transforms in order, so a rewrite sees the values copied by the previous transforms.
+func (t *transformer) apply(request *http.Request, responseHeader http.Header, claims map[string]interface{}) {
+	for _, rule := range t.rules {
+		if rule.Target == "request" || rule.Target == "both" {
+			rule.apply(request.Header, claims)
+		}
+		if rule.Target == "response" || rule.Target == "both" {
+			rule.apply(responseHeader, claims)
+		}
+	}
+}
+
+func (rule *transformRule) apply(header http.Header, claims map[string]interface{}) {
+	switch rule.Action {
+	case "copy":
+		if value, ok := claimValue(claims, rule.Claim); ok {
+			rule.set(header, rule.claimHeaderValue(value))
+		}
+	case "drop":
+		header.Del(rule.Header)
+	case "rewrite":
+		values := header.Values(rule.Header)
+		header.Del(rule.Header)
+		for _, value := range values {
+			header.Add(rule.Header, rule.regex.ReplaceAllString(value, rule.Replacement))
+		}
+	case "mint":
+		var value bytes.Buffer
+		if err := rule.template.Execute(&value, claims); err == nil {
+			rule.set(header, value.String())
+		}
+	}
+}
+
+// claimValue looks up a claim by name, or by a dot-separated path into nested claims
+// (e.g. address.country or resource_access.account.roles.0) when no claim has the name.
+func claimValue(claims map[string]interface{}, claim string) (interface{}, bool) {
+	if value, ok := claims[claim]; ok {
+		return value, true
+	}
+	return valueAtPath(claims, claim)
+}
+
+// claimHeaderValue converts a claim into a header value, arrays of strings, numbers and booleans are joined
+// with the delimiter.
+func (rule *transformRule) claimHeaderValue(value interface{}) string {
+	elements, ok := value.([]interface{})
+	if !ok || rule.delimiter == "" {
+		return headerValue(value)
+	}
+	values := make([]string, 0, len(elements))
+	for _, element := range elements {
+		switch element.(type) {
+		case string, float64, bool:
+			values = append(values, fmt.Sprint(element))
+		default:
+			return headerValue(value)
+		}
+	}
+	return strings.Join(values, rule.delimiter)
+}
+
+func (rule *transformRule) set(header http.Header, value string) {
+	if rule.Mode == "override" {
+		header.Set(rule.Header, value)
+	} else {
+		header.Add(rule.Header, value)
+	}
+}
@@ -0,0 +1,258 @@
+package traefik_jwt_plugin
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Finding is a problem in a configuration, reported by ValidateConfig.
+type Finding struct {
+	// Severity is error (New rejects the configuration) or warning (the configuration works, but is risky)
+	Severity string `json:"severity"`
+	// Field is the configuration field the finding is about
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (finding Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", finding.Severity, finding.Field, finding.Message)
+}
+
+// ValidateConfig checks a configuration without starting a plugin instance, e.g. in CI pipelines
+// which template the Traefik configuration. Besides invalid values, which New rejects, it reports
+// risky combinations of settings, which New accepts.
+func ValidateConfig(config *Config) []Finding {
+	var findings []Finding
+	errorf := func(field string, format string, args ...interface{}) {
+		findings = append(findings, Finding{Severity: "error", Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	warnf := func(field string, format string, args ...interface{}) {
+		findings = append(findings, Finding{Severity: "warning", Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	durations := []struct {
+		field string
+		value string
+	}{
+		{"OpaTimeout", config.OpaTimeout},
+		{"OpaRetryBackoff", config.OpaRetryBackoff},
+		{"OpaCacheTTL", config.OpaCacheTTL},
+		{"JwksTimeout", config.JwksTimeout},
+		{"KeyFilesInterval", config.KeyFilesInterval},
+		{"Introspection.CacheTTL", config.Introspection.CacheTTL},
+		{"RevocationInterval", config.RevocationInterval},
+		{"MaxTokenLifetime", config.MaxTokenLifetime},
+		{"ClockSkew", config.ClockSkew},
+		{"RateLimit.Period", config.RateLimit.Period},
+		{"FaultInjection.VerifyLatency", config.FaultInjection.VerifyLatency},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(duration.value); err != nil {
+			errorf(duration.field, "%v", err)
+		}
+	}
+	if config.Alg != "" {
+		if _, ok := tokenAlgorithms[config.Alg]; !ok {
+			errorf("Alg", "unknown algorithm %s", config.Alg)
+		}
+	}
+
+	if config.LogLevel != "" {
+		if _, ok := logLevels[config.LogLevel]; !ok {
+			errorf("LogLevel", "unknown level %s", config.LogLevel)
+		}
+	}
+	switch config.ErrorMode {
+	case "", "terminate":
+	case "forward", "forward-with-error-header":
+		if config.ForwardAuthErrorHeader == "" {
+			errorf("ErrorMode", "%s requires a ForwardAuthErrorHeader", config.ErrorMode)
+		}
+	default:
+		errorf("ErrorMode", "unknown mode %s", config.ErrorMode)
+	}
+	statuses := []struct {
+		field string
+		value int
+	}{
+		{"UnauthorizedStatus", config.UnauthorizedStatus},
+		{"ForbiddenStatus", config.ForbiddenStatus},
+	}
+	for _, status := range statuses {
+		if status.value != 0 && !isErrorStatus(status.value) {
+			errorf(status.field, "status %d is not a 4xx or 5xx status", status.value)
+		}
+	}
+
+	if config.DecisionLogUrl != "" {
+		if _, err := parseDecisionLogURL(config.DecisionLogUrl); err != nil {
+			errorf("DecisionLogUrl", "%v", err)
+		}
+	}
+
+	jwksEndpoints := 0
+	for _, key := range config.Keys {
+		if u, err := url.ParseRequestURI(key); err == nil && u.Host != "" {
+			jwksEndpoints++
+		}
+	}
+	for _, audience := range config.GoogleIap.Audiences {
+		if !iapAudience.MatchString(audience) {
+			errorf("GoogleIap.Audiences", "audience %s is not an IAP audience, expecting /projects/PROJECT_NUMBER/global/backendServices/SERVICE_ID or /projects/PROJECT_NUMBER/apps/PROJECT_ID", audience)
+		}
+	}
+	for i, secret := range config.HmacSecrets {
+		if envVariable.MatchString(secret) {
+			// the secret is only known at startup
+			continue
+		}
+		_, secret, err := splitKid(secret)
+		if err != nil {
+			errorf("HmacSecrets", "%v", err)
+			continue
+		}
+		if key, err := hmacSecret(secret); err != nil {
+			errorf("HmacSecrets", "%v", err)
+		} else if len(key) < 32 {
+			warnf("HmacSecrets", "secret %d is shorter than 32 bytes, which is easy to brute force", i)
+		}
+	}
+	if strings.HasPrefix(config.Introspection.Url, "http://") && config.Introspection.ClientSecret != "" {
+		warnf("Introspection", "client credentials and tokens are sent to the introspection endpoint over plain HTTP")
+	}
+	if strings.HasPrefix(config.TokenExchange.Url, "http://") {
+		warnf("TokenExchange", "tokens are sent to the token exchange endpoint over plain HTTP")
+	}
+	globalKeys := len(config.Keys) > 0 || len(config.HmacSecrets) > 0
+	// requests to other hosts than the tenants are rejected, only the keys of the tenants are used
+	if !globalKeys && len(config.Tenants) == 0 && config.TrustedIdentityHeader == "" && config.Introspection.Url == "" {
+		warnf("Keys", "no keys configured, token signatures are not verified")
+	}
+	tenants := make([]string, 0, len(config.Tenants))
+	for host := range config.Tenants {
+		tenants = append(tenants, host)
+	}
+	sort.Strings(tenants)
+	for _, host := range tenants {
+		if config.Tenants[host].JwksUrl == "" && !globalKeys {
+			warnf("Tenants", "tenant %s has no JwksUrl and no keys are configured, its token signatures are not verified", host)
+		}
+	}
+	if strings.HasPrefix(config.Alg, "HS") && jwksEndpoints > 0 {
+		warnf("Alg", "symmetric algorithm %s combined with JWKS endpoints, which publish asymmetric keys", config.Alg)
+	}
+	if len(config.PayloadFields) > 0 && !config.Required {
+		warnf("Required", "PayloadFields are configured but not required, tokens without them are only logged")
+	}
+	if config.OpaUrl != "" && (config.OpaFailureMode == "open" || config.OpaFailureMode == "open-readonly") && config.Alg == "" {
+		warnf("OpaFailureMode", "OPA fails open while any algorithm is accepted, restrict Alg")
+	}
+	if config.OpaUrl != "" && config.OpaAllowField == "" {
+		errorf("OpaAllowField", "OpaUrl is configured without an OpaAllowField, every request would be rejected")
+	}
+	if config.EnableMagicToken && config.ForwardAuthHeader == "" {
+		errorf("ForwardAuthHeader", "EnableMagicToken requires a ForwardAuthHeader for the MagicTokenForwardAuth")
+	}
+	for header := range config.JwtHeaders {
+		if reservedHeader(header) {
+			errorf("JwtHeaders", "header %s is reserved and can't be set from a claim", header)
+		}
+	}
+	for _, rule := range config.JwtHeaderRules {
+		if reservedHeader(rule.Header) {
+			errorf("JwtHeaderRules", "header %s is reserved and can't be set from a claim", rule.Header)
+		}
+	}
+	for _, transform := range config.Transforms {
+		if (transform.Action == "copy" || transform.Action == "mint") && reservedHeader(transform.Header) {
+			errorf("Transforms", "header %s is reserved and can't be set from a claim", transform.Header)
+		}
+	}
+	if strings.HasPrefix(config.OpaUrl, "http://") && len(config.OpaAuthHeaders) > 0 {
+		warnf("OpaAuthHeaders", "credentials are sent to OPA over plain HTTP")
+	}
+	if strings.HasPrefix(config.OpaUrl, "http://") && config.OpaIncludeToken {
+		warnf("OpaIncludeToken", "tokens are sent to OPA over plain HTTP")
+	}
+	if config.EnableMagicToken {
+		warnf("EnableMagicToken", "the magic token bypasses all token checks")
+	}
+	if config.TrustedIdentityHeader != "" && config.TrustedIdentityFormat != "jwt" && len(config.TrustedIdentitySourceRanges) == 0 {
+		errorf("TrustedIdentitySourceRanges", "unsigned identities in %s are accepted from any client without TrustedIdentitySourceRanges", config.TrustedIdentityHeader)
+	}
+	for _, sourceRange := range config.TrustedIdentitySourceRanges {
+		if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+			errorf("TrustedIdentitySourceRanges", "%v", err)
+		}
+	}
+	for i, rule := range config.NetworkRules {
+		if rule.Claim == "" || len(rule.AnyOf) == 0 || len(rule.SourceRanges) == 0 {
+			errorf("NetworkRules", "network rule %d needs a claim, anyOf and sourceRanges", i)
+		}
+		for _, sourceRange := range rule.SourceRanges {
+			if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+				errorf("NetworkRules", "invalid source range of network rule %d: %v", i, err)
+			}
+		}
+	}
+	for _, source := range config.Expressions {
+		if _, err := compileExpression(source); err != nil {
+			errorf("Expressions", "invalid expression %q: %v", source, err)
+		}
+	}
+	for i, token := range config.MagicTokens {
+		if token.Token == "" {
+			errorf("MagicTokens", "magic token %d has no token", i)
+		}
+		if token.Expires != "" {
+			if _, err := time.Parse(time.RFC3339, token.Expires); err != nil {
+				errorf("MagicTokens", "invalid expiry of magic token %d: %v", i, err)
+			}
+		}
+		for _, sourceRange := range token.SourceRanges {
+			if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+				errorf("MagicTokens", "invalid source range of magic token %d: %v", i, err)
+			}
+		}
+	}
+	if len(config.ServiceTokenSubjects) > 0 && !config.ValidateExpiry && config.MaxTokenLifetime == "" {
+		warnf("ServiceTokenSubjects", "ServiceTokenSubjects has no effect unless ValidateExpiry or MaxTokenLifetime is enabled")
+	}
+	if config.AnonymousIdentity && config.OpaUrl == "" {
+		warnf("AnonymousIdentity", "anonymous requests are allowed without an OPA policy")
+	}
+	return findings
+}
+
+// reservedHeader tells whether the header carries the credentials or the framing of the request,
+// which must not be set from the claims of a token.
+func reservedHeader(header string) bool {
+	switch http.CanonicalHeaderKey(header) {
+	case "Authorization", "Proxy-Authorization", "Host", "Content-Length", "Transfer-Encoding", "Connection",
+		"Upgrade", "Te", "Trailer", "Keep-Alive", "Proxy-Connection", "Cookie":
+		return true
+	}
+	return false
+}
+
+// validateConfig returns the errors reported by ValidateConfig, combined into a single error.
+func validateConfig(config *Config) error {
+	var errs []string
+	for _, finding := range ValidateConfig(config) {
+		if finding.Severity == "error" {
+			errs = append(errs, finding.Field+": "+finding.Message)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}